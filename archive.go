@@ -0,0 +1,136 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// ExportZip writes the whole database to w as a zip archive holding one
+// collection/resource entry per record. Records are copied one at a time,
+// and each collection is locked only while it is being exported.
+func (d *Driver) ExportZip(w io.Writer) error {
+	zw := zip.NewWriter(w)
+
+	collections, err := d.collections()
+	if err != nil {
+		return err
+	}
+
+	for _, collection := range collections {
+		if err := d.exportCollectionZip(zw, collection); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+func (d *Driver) exportCollectionZip(zw *zip.Writer, collection string) error {
+	mutex := d.lockCollection(collection)
+	defer mutex.Unlock()
+
+	return d.eachRecordFile(collection, func(resource, file string, fi os.FileInfo) error {
+		return d.copyToZip(zw, path.Join(collection, resource+d.codec.Ext()), file, fi)
+	})
+}
+
+// copyToZip adds a record file to the archive, decompressed if it was
+// stored compressed.
+func (d *Driver) copyToZip(zw *zip.Writer, name, src string, fi os.FileInfo) error {
+	f, err := d.openRecordFile(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hdr, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	hdr.Method = zip.Deflate
+
+	w, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// ImportZip writes every record found in a zip archive produced by
+// ExportZip into the database, replacing records with the same name.
+// Entries that aren't collection/resource records are ignored.
+func (d *Driver) ImportZip(r io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range zr.File {
+		collection, resource, ok := d.splitEntry(f.Name)
+		if !ok {
+			continue
+		}
+
+		if err := d.importZipEntry(f, collection, resource); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *Driver) importZipEntry(f *zip.File, collection, resource string) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	var src io.Reader = rc
+	if d.maxInput > 0 {
+		// Read one byte past the limit so checkInput can tell it was hit.
+		src = io.LimitReader(rc, int64(d.maxInput)+1)
+	}
+
+	b, err := ioutil.ReadAll(src)
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %w", f.Name, err)
+	}
+	if err := d.checkInput(f.Name, b); err != nil {
+		return err
+	}
+
+	mutex := d.lockCollection(collection)
+	defer mutex.Unlock()
+
+	return d.writeRecord(collection, resource, b)
+}
+
+// splitEntry splits an archive entry name of the form collection/resource
+// plus the codec's extension. With HierarchicalKeys the resource may span
+// several path segments.
+func (d *Driver) splitEntry(name string) (collection, resource string, ok bool) {
+	parts := strings.Split(name, "/")
+	if len(parts) < 2 || (len(parts) > 2 && !d.hierarchical) || !strings.HasSuffix(name, d.codec.Ext()) {
+		return "", "", false
+	}
+
+	collection = parts[0]
+	resource = strings.TrimSuffix(strings.Join(parts[1:], "/"), d.codec.Ext())
+	if collection == "" || collection == "." || collection == ".." || isInternal(collection) {
+		return "", "", false
+	}
+	if d.checkResource(resource) != nil {
+		return "", "", false
+	}
+
+	return collection, resource, true
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestZipRoundTrip(t *testing.T) {
+	src := newTestDriver(t, nil)
+	writeEmployees(t, src)
+	if err := src.Write("orders", "1", map[string]interface{}{"user": "Eren"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := src.ExportZip(&buf); err != nil {
+		t.Fatalf("ExportZip: %v", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("reading archive: %v", err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("opening %s: %v", f.Name, err)
+		}
+		got, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("reading %s: %v", f.Name, err)
+		}
+		want, err := ioutil.ReadFile(filepath.Join(src.Dir(), filepath.FromSlash(f.Name)))
+		if err != nil {
+			t.Fatalf("reading source of %s: %v", f.Name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("entry %s = %q, want %q", f.Name, got, want)
+		}
+	}
+	sort.Strings(names)
+	want := []string{
+		"orders/1.json",
+		"users/Eren.json", "users/Erwin.json", "users/Johan.json",
+		"users/Maximilian.json", "users/Mikasa.json", "users/Reiner.json",
+	}
+	if len(names) != len(want) {
+		t.Fatalf("entries = %v, want %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("entries = %v, want %v", names, want)
+		}
+	}
+
+	dst := newTestDriver(t, nil)
+	if err := dst.ImportZip(bytes.NewReader(buf.Bytes()), int64(buf.Len())); err != nil {
+		t.Fatalf("ImportZip: %v", err)
+	}
+
+	srcDigest, err := src.Digest()
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+	dstDigest, err := dst.Digest()
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+	if srcDigest != dstDigest {
+		t.Error("imported database differs from the exported one")
+	}
+}
+
+func TestImportZipIgnoresForeignEntries(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"README.txt", "users/../../escape.json", "a/b/c.json", "users/Eren.json"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(`{"Name": "Eren"}`))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db := newTestDriver(t, nil)
+	if err := db.ImportZip(bytes.NewReader(buf.Bytes()), int64(buf.Len())); err != nil {
+		t.Fatalf("ImportZip: %v", err)
+	}
+
+	counts, err := db.CollectionCounts()
+	if err != nil {
+		t.Fatalf("CollectionCounts: %v", err)
+	}
+	if len(counts) != 1 || counts["users"] != 1 {
+		t.Errorf("CollectionCounts() = %v, want only users/Eren imported", counts)
+	}
+}
+
+func TestExportZipDecompressesRecords(t *testing.T) {
+	src := newTestDriver(t, &Options{CompressOverBytes: 16})
+	writeEmployees(t, src)
+
+	var buf bytes.Buffer
+	if err := src.ExportZip(&buf); err != nil {
+		t.Fatalf("ExportZip: %v", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("reading archive: %v", err)
+	}
+	for _, f := range zr.File {
+		if filepath.Ext(f.Name) != ".json" {
+			t.Errorf("entry %s doesn't carry the codec's extension", f.Name)
+		}
+	}
+
+	dst := newTestDriver(t, nil)
+	if err := dst.ImportZip(bytes.NewReader(buf.Bytes()), int64(buf.Len())); err != nil {
+		t.Fatalf("ImportZip: %v", err)
+	}
+	users, err := ReadAllTyped[User](dst, "users")
+	if err != nil {
+		t.Fatalf("ReadAllTyped: %v", err)
+	}
+	if len(users) != 6 {
+		t.Errorf("imported %d users, want 6", len(users))
+	}
+
+	srcDigest, _ := src.Digest()
+	dstDigest, _ := dst.Digest()
+	if srcDigest != dstDigest {
+		t.Error("compressed and uncompressed copies of the same data have different digests")
+	}
+}
+
+func TestImportZipInputLimits(t *testing.T) {
+	archive := func(name, content string) *bytes.Reader {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return bytes.NewReader(buf.Bytes())
+	}
+
+	db := newTestDriver(t, &Options{MaxInputBytes: 1024, MaxInputDepth: 10})
+
+	ok := archive("users/Eren.json", `{"Name": "Eren", "Address": {"City": "Shiganshina"}}`)
+	if err := db.ImportZip(ok, ok.Size()); err != nil {
+		t.Fatalf("ImportZip of an ordinary record: %v", err)
+	}
+
+	nested := archive("users/deep.json", strings.Repeat("[", 50)+strings.Repeat("]", 50))
+	if err := db.ImportZip(nested, nested.Size()); !errors.Is(err, ErrInputTooComplex) {
+		t.Errorf("ImportZip of a deeply nested record = %v, want ErrInputTooComplex", err)
+	}
+
+	huge := archive("users/huge.json", `{"Name": "`+strings.Repeat("a", 2048)+`"}`)
+	if err := db.ImportZip(huge, huge.Size()); !errors.Is(err, ErrInputTooComplex) {
+		t.Errorf("ImportZip of an oversized record = %v, want ErrInputTooComplex", err)
+	}
+
+	if n, _ := db.EstimateCount("users"); n != 1 {
+		t.Errorf("%d records imported, want only Eren", n)
+	}
+}
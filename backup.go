@@ -0,0 +1,200 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrCorruptBackup = errors.New("backup archive is corrupt")
+
+// BackupInfo summarises a backup archive checked by VerifyBackup.
+type BackupInfo struct {
+	Collections []string
+	Records     int
+	Errors      []string
+}
+
+// Backup writes the whole database to w as a gzipped tar archive holding
+// one collection/resource entry per record. Every collection is locked
+// for the duration, so the archive matches a single point in time. With
+// BackupConcurrent set the locks are only held while the records are
+// hard linked into a snapshot, which is then archived without them.
+func (d *Driver) Backup(w io.Writer) error {
+	if d.backupConc {
+		return d.backupSnapshot(w)
+	}
+
+	unlock := d.lockAll()
+	defer unlock()
+
+	collections, err := d.collections()
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+
+	for _, collection := range collections {
+		err := d.eachRecordFile(collection, func(resource, file string, fi os.FileInfo) error {
+			b, err := d.readRecordFile(file)
+			if err != nil {
+				return err
+			}
+
+			return writeBackupEntry(tw, path.Join(collection, resource+d.codec.Ext()), b, fi.ModTime())
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+func writeBackupEntry(tw *tar.Writer, name string, b []byte, modTime time.Time) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(b)),
+		ModTime: modTime,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	_, err := tw.Write(b)
+	return err
+}
+
+// backupSnapshot is Backup for BackupConcurrent: it backs up a Snapshot,
+// which only needs the locks while it is taken.
+func (d *Driver) backupSnapshot(w io.Writer) error {
+	snapshot, err := d.OpenSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+
+	return snapshot.db.Backup(w)
+}
+
+// RestoreRecord finds the record collection/resource in a backup archive
+// produced by Backup and writes it back into d, leaving every other record
+// alone. It fails with ErrRecordNotFound if the archive doesn't hold it.
+func RestoreRecord(r io.Reader, collection, resource string, d *Driver) error {
+	if collection == "" {
+		return fmt.Errorf("missing collection - no place to restore record")
+	}
+	if resource == "" {
+		return fmt.Errorf("missing resource - unable to restore")
+	}
+	if err := d.checkResource(resource); err != nil {
+		return err
+	}
+
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCorruptBackup, err)
+	}
+	defer zr.Close()
+
+	name := path.Join(collection, resource+d.codec.Ext())
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("%s is not in the backup: %w", name, ErrRecordNotFound)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrCorruptBackup, err)
+		}
+		if hdr.Name != name || hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrCorruptBackup, name, err)
+		}
+		if err := d.checkInput(name, b); err != nil {
+			return err
+		}
+
+		return d.withTimeout(func() error {
+			mutex := d.lockCollection(collection)
+			defer mutex.Unlock()
+
+			return d.writeRecord(collection, resource, b)
+		})
+	}
+}
+
+// VerifyBackup reads a backup archive produced by Backup without restoring
+// it, checking that every entry decompresses and that JSON records parse.
+// It returns a summary of what the archive holds; problems with single
+// entries are listed in its Errors and reported as ErrCorruptBackup.
+func VerifyBackup(r io.Reader) (BackupInfo, error) {
+	var info BackupInfo
+
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return info, fmt.Errorf("%w: %v", ErrCorruptBackup, err)
+	}
+	defer zr.Close()
+
+	collections := make(map[string]bool)
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return info, fmt.Errorf("%w: %v", ErrCorruptBackup, err)
+		}
+
+		parts := strings.Split(hdr.Name, "/")
+		if hdr.Typeflag != tar.TypeReg || len(parts) < 2 || parts[0] == "" || parts[len(parts)-1] == "" {
+			info.Errors = append(info.Errors, fmt.Sprintf("%s: not a collection/resource record", hdr.Name))
+			continue
+		}
+
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return info, fmt.Errorf("%w: %s: %v", ErrCorruptBackup, hdr.Name, err)
+		}
+		if path.Ext(hdr.Name) == ".json" && !json.Valid(b) {
+			info.Errors = append(info.Errors, fmt.Sprintf("%s: invalid JSON", hdr.Name))
+			continue
+		}
+
+		collections[parts[0]] = true
+		info.Records++
+	}
+
+	for collection := range collections {
+		info.Collections = append(info.Collections, collection)
+	}
+	sort.Strings(info.Collections)
+
+	if len(info.Errors) > 0 {
+		return info, fmt.Errorf("%w: %d bad entries", ErrCorruptBackup, len(info.Errors))
+	}
+
+	return info, nil
+}
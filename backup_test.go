@@ -0,0 +1,172 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestVerifyBackup(t *testing.T) {
+	db := newTestDriver(t, &Options{CompressOverBytes: 64})
+	writeEmployees(t, db)
+	if err := db.Write("orders", "1", []int{1}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := db.Backup(&buf); err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+
+	info, err := VerifyBackup(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("VerifyBackup: %v (%v)", err, info.Errors)
+	}
+	want := BackupInfo{Collections: []string{"orders", "users"}, Records: 7}
+	if !reflect.DeepEqual(info, want) {
+		t.Errorf("VerifyBackup = %+v, want %+v", info, want)
+	}
+
+	truncated := buf.Bytes()[:buf.Len()/2]
+	if _, err := VerifyBackup(bytes.NewReader(truncated)); !errors.Is(err, ErrCorruptBackup) {
+		t.Errorf("VerifyBackup of a truncated archive = %v, want ErrCorruptBackup", err)
+	}
+}
+
+// writeHook calls fn before its first write to the underlying writer.
+type writeHook struct {
+	io.Writer
+	fn func()
+}
+
+func (w *writeHook) Write(p []byte) (int, error) {
+	if w.fn != nil {
+		w.fn()
+		w.fn = nil
+	}
+	return w.Writer.Write(p)
+}
+
+func TestBackupConcurrent(t *testing.T) {
+	db := newTestDriver(t, &Options{BackupConcurrent: true})
+	writeEmployees(t, db)
+
+	var buf bytes.Buffer
+	w := &writeHook{Writer: &buf, fn: func() {
+		done := make(chan error, 1)
+		go func() {
+			done <- db.Write("users", "Eren", User{Name: "Eren", Age: "99"})
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Write during backup: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Write blocked while the archive was written")
+		}
+	}}
+	if err := db.Backup(w); err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+
+	info, err := VerifyBackup(bytes.NewReader(buf.Bytes()))
+	if err != nil || info.Records != 6 {
+		t.Fatalf("VerifyBackup = %+v, %v, want 6 records", info, err)
+	}
+
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			t.Fatal("archive has no users/Eren.json")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name != "users/Eren.json" {
+			continue
+		}
+
+		var u User
+		if err := json.NewDecoder(tr).Decode(&u); err != nil {
+			t.Fatal(err)
+		}
+		if u.Age != "29" {
+			t.Errorf("archived Eren has Age %q, want 29 from before the backup started", u.Age)
+		}
+		break
+	}
+
+	if recovery, leftovers, err := db.NeedsRecovery(); err != nil || recovery {
+		t.Errorf("NeedsRecovery after backup = %v, %v, %v", recovery, leftovers, err)
+	}
+}
+
+func TestRestoreRecord(t *testing.T) {
+	db := newTestDriver(t, &Options{CompressOverBytes: 64})
+	writeEmployees(t, db)
+
+	var buf bytes.Buffer
+	if err := db.Backup(&buf); err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	backup := buf.Bytes()
+
+	if err := db.Write("users", "Eren", User{Name: "Eren", Age: "99"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := db.Write("users", "Mikasa", User{Name: "Mikasa", Age: "99"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if err := RestoreRecord(bytes.NewReader(backup), "users", "Eren", db); err != nil {
+		t.Fatalf("RestoreRecord: %v", err)
+	}
+
+	var u User
+	if err := db.Read("users", "Eren", &u); err != nil || u.Age != "29" || u.Company != "Domini" {
+		t.Errorf("restored Eren = %+v, %v, want the backed up record", u, err)
+	}
+	if err := db.Read("users", "Mikasa", &u); err != nil || u.Age != "99" {
+		t.Errorf("Mikasa = %+v, %v, want the newer record left alone", u, err)
+	}
+
+	if err := RestoreRecord(bytes.NewReader(backup), "users", "Levi", db); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("RestoreRecord of a record not backed up = %v, want ErrRecordNotFound", err)
+	}
+}
+
+func TestVerifyBackupReportsBadEntries(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for name, body := range map[string]string{
+		"users/Eren.json": `{"Name": "Eren"}`,
+		"users/Levi.json": `{"Name": `,
+		"stray.json":      `{}`,
+	} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(body))})
+		tw.Write([]byte(body))
+	}
+	tw.Close()
+	zw.Close()
+
+	info, err := VerifyBackup(&buf)
+	if !errors.Is(err, ErrCorruptBackup) {
+		t.Fatalf("VerifyBackup = %v, want ErrCorruptBackup", err)
+	}
+	if info.Records != 1 || len(info.Errors) != 2 {
+		t.Errorf("VerifyBackup = %+v, want one good record and two errors", info)
+	}
+}
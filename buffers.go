@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// bufferPool holds the buffers ReadAllBuffered reads records into.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// ReadAllBuffered is ReadAll for large collections: it reads the records
+// into buffers shared between calls rather than allocating a string for
+// each. The records may only be used until release is called, which hands
+// the buffers back for reuse; release must be called exactly once. Temp
+// files of interrupted writes are skipped.
+func (d *Driver) ReadAllBuffered(collection string) (records [][]byte, release func(), err error) {
+	if collection == "" {
+		return nil, nil, fmt.Errorf("missing collection - no place to read record")
+	}
+
+	var buffers []*bytes.Buffer
+	release = func() {
+		for _, buf := range buffers {
+			buf.Reset()
+			bufferPool.Put(buf)
+		}
+		buffers = nil
+	}
+
+	err = d.withTimeout(func() error {
+		mutex := d.lockCollection(collection)
+		defer mutex.Unlock()
+
+		if _, err := d.stat(filepath.Join(d.Dir(), collection)); err != nil {
+			return err
+		}
+
+		return d.eachRecordFile(collection, func(resource, path string, fi os.FileInfo) error {
+			if d.maxReadAll > 0 && len(records) == d.maxReadAll {
+				return fmt.Errorf("collection %s has more than %d records: %w", collection, d.maxReadAll, ErrResultTooLarge)
+			}
+
+			r, err := d.openRecordFile(path)
+			if err != nil {
+				return err
+			}
+			buf := bufferPool.Get().(*bytes.Buffer)
+			buffers = append(buffers, buf)
+			_, err = buf.ReadFrom(r)
+			r.Close()
+			if err != nil {
+				return err
+			}
+
+			b, err := d.plain(collection, buf.Bytes())
+			if err != nil {
+				return err
+			}
+			records = append(records, b)
+			return nil
+		})
+	})
+	if err != nil {
+		// A timed out read may still be filling the buffers, so they are
+		// left for the garbage collector rather than put back.
+		return nil, nil, err
+	}
+
+	return records, release, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func TestReadAllBuffered(t *testing.T) {
+	db := newTestDriver(t, &Options{CompressOverBytes: 100})
+	writeEmployees(t, db)
+
+	want, err := db.ReadAll("users")
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+
+	records, release, err := db.ReadAllBuffered("users")
+	if err != nil {
+		t.Fatalf("ReadAllBuffered: %v", err)
+	}
+	got := make([]string, len(records))
+	for i, b := range records {
+		got[i] = string(b)
+	}
+	release()
+
+	sort.Strings(want)
+	sort.Strings(got)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("ReadAllBuffered = %v, want %v", got, want)
+	}
+
+	if _, _, err := db.ReadAllBuffered("missing"); err == nil {
+		t.Error("ReadAllBuffered of a missing collection succeeded")
+	}
+}
+
+func benchmarkReadAll(b *testing.B, read func(db *Driver) error) {
+	db := newTestDriver(b, nil)
+	if err := db.WriteBatch("users", benchmarkRecords(1000)); err != nil {
+		b.Fatalf("WriteBatch: %v", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := read(db); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadAll(b *testing.B) {
+	benchmarkReadAll(b, func(db *Driver) error {
+		_, err := db.ReadAll("users")
+		return err
+	})
+}
+
+func BenchmarkReadAllBuffered(b *testing.B) {
+	benchmarkReadAll(b, func(db *Driver) error {
+		_, release, err := db.ReadAllBuffered("users")
+		if err == nil {
+			release()
+		}
+		return err
+	})
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cache is a size-bounded LRU of stored record bytes shared by Read and
+// the write paths. A nil *cache caches nothing.
+type cache struct {
+	mutex   sync.Mutex
+	size    int
+	order   *list.List
+	items   map[cacheKey]*list.Element
+	onEvict func(collection, resource string, value []byte)
+}
+
+type cacheKey struct {
+	collection string
+	resource   string
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	value   []byte
+	modTime time.Time
+}
+
+func newCache(size int, onEvict func(collection, resource string, value []byte)) *cache {
+	if size <= 0 {
+		return nil
+	}
+
+	return &cache{
+		size:    size,
+		order:   list.New(),
+		items:   make(map[cacheKey]*list.Element),
+		onEvict: onEvict,
+	}
+}
+
+func (c *cache) get(collection, resource string) (*cacheEntry, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	el, ok := c.items[cacheKey{collection, resource}]
+	if !ok {
+		return nil, false
+	}
+
+	c.order.MoveToFront(el)
+	return el.Value.(*cacheEntry), true
+}
+
+func (c *cache) put(collection, resource string, value []byte, modTime time.Time) {
+	if c == nil {
+		return
+	}
+
+	key := cacheKey{collection, resource}
+	entry := &cacheEntry{key: key, value: value, modTime: modTime}
+
+	c.mutex.Lock()
+	if el, ok := c.items[key]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		c.mutex.Unlock()
+		return
+	}
+
+	c.items[key] = c.order.PushFront(entry)
+
+	var evicted []*cacheEntry
+	for c.order.Len() > c.size {
+		evicted = append(evicted, c.unlink(c.order.Back()))
+	}
+	c.mutex.Unlock()
+
+	c.evicted(evicted)
+}
+
+func (c *cache) remove(collection, resource string) {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	var evicted []*cacheEntry
+	if el, ok := c.items[cacheKey{collection, resource}]; ok {
+		evicted = append(evicted, c.unlink(el))
+	}
+	c.mutex.Unlock()
+
+	c.evicted(evicted)
+}
+
+// removeCollection drops every entry of the collection and of any
+// collection nested under it.
+func (c *cache) removeCollection(collection string) {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	var evicted []*cacheEntry
+	for key, el := range c.items {
+		if key.collection == collection || strings.HasPrefix(key.collection, collection+"/") {
+			evicted = append(evicted, c.unlink(el))
+		}
+	}
+	c.mutex.Unlock()
+
+	c.evicted(evicted)
+}
+
+// unlink must be called with c.mutex held.
+func (c *cache) unlink(el *list.Element) *cacheEntry {
+	entry := c.order.Remove(el).(*cacheEntry)
+	delete(c.items, entry.key)
+	return entry
+}
+
+// evicted runs the eviction callback outside the cache's lock. Callers
+// usually still hold a collection lock, so the callback can't use the
+// Driver.
+func (c *cache) evicted(entries []*cacheEntry) {
+	if c.onEvict == nil {
+		return
+	}
+
+	for _, entry := range entries {
+		c.onEvict(entry.key.collection, entry.key.resource, entry.value)
+	}
+}
+
+// WarmCache reads the collection's records into the cache, in name order,
+// stopping once it holds CacheSize of them so none push out each other.
+// It returns how many records were cached, 0 when there is no cache.
+func (d *Driver) WarmCache(collection string) (int, error) {
+	if collection == "" {
+		return 0, fmt.Errorf("missing collection - no place to read record")
+	}
+	if d.cache == nil {
+		return 0, nil
+	}
+
+	return timed(d, func() (int, error) {
+		mutex := d.lockCollection(collection)
+		defer mutex.Unlock()
+
+		n := 0
+		err := d.eachRecordFile(collection, func(resource, path string, fi os.FileInfo) error {
+			if n == d.cache.size {
+				return errSampled
+			}
+
+			b, err := d.readRecordFile(path)
+			if err != nil {
+				return err
+			}
+
+			d.cache.put(collection, resource, b, fi.ModTime())
+			n++
+			return nil
+		})
+		if err != nil && err != errSampled {
+			return n, err
+		}
+
+		return n, nil
+	})
+}
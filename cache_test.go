@@ -0,0 +1,141 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOnEvict(t *testing.T) {
+	var mutex sync.Mutex
+	var evicted []string
+	db := newTestDriver(t, &Options{
+		CacheSize: 2,
+		OnEvict: func(collection, resource string, value []byte) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			evicted = append(evicted, collection+"/"+resource)
+		},
+	})
+
+	for _, name := range []string{"a", "b", "c", "d"} {
+		if err := db.Write("users", name, User{Name: name}); err != nil {
+			t.Fatalf("Write %s: %v", name, err)
+		}
+	}
+	if want := []string{"users/a", "users/b"}; !reflect.DeepEqual(evicted, want) {
+		t.Errorf("evicted = %v, want %v", evicted, want)
+	}
+
+	var u User
+	if err := db.Read("users", "a", &u); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if want := []string{"users/a", "users/b", "users/c"}; !reflect.DeepEqual(evicted, want) {
+		t.Errorf("evicted after reading a = %v, want %v", evicted, want)
+	}
+
+	if err := db.Delete("users", "d"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if want := []string{"users/a", "users/b", "users/c", "users/d"}; !reflect.DeepEqual(evicted, want) {
+		t.Errorf("evicted after deleting d = %v, want %v", evicted, want)
+	}
+}
+
+// pausingStorage stops after reading a file's bytes and waits for proceed
+// before returning them, holding a reader between its read and its cache
+// fill.
+type pausingStorage struct {
+	read    chan struct{}
+	proceed chan struct{}
+}
+
+func (s pausingStorage) ReadFile(name string) ([]byte, error) {
+	b, err := osStorage{}.ReadFile(name)
+	s.read <- struct{}{}
+	<-s.proceed
+	return b, err
+}
+
+func TestCacheFillDoesNotOverwriteNewerWrite(t *testing.T) {
+	db := newTestDriver(t, &Options{CacheSize: 10})
+	if err := db.Write("users", "Eren", User{Name: "Eren", Company: "old"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	db.cache.remove("users", "Eren")
+
+	storage := pausingStorage{read: make(chan struct{}), proceed: make(chan struct{})}
+	db.storage = storage
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		var u User
+		if err := db.Read("users", "Eren", &u); err != nil {
+			t.Errorf("Read: %v", err)
+		}
+	}()
+
+	<-storage.read
+	written := make(chan struct{})
+	go func() {
+		defer wg.Done()
+		defer close(written)
+		if err := db.Write("users", "Eren", User{Name: "Eren", Company: "new"}); err != nil {
+			t.Errorf("Write: %v", err)
+		}
+	}()
+
+	// Give the write a chance to finish while the reader is paused; it
+	// shouldn't be able to, since the reader holds the collection lock.
+	select {
+	case <-written:
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(storage.proceed)
+	wg.Wait()
+
+	db.storage = osStorage{}
+	var u User
+	if err := db.Read("users", "Eren", &u); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if u.Company != "new" {
+		t.Errorf("Company = %q, want the newer write's value", u.Company)
+	}
+}
+
+func TestWarmCache(t *testing.T) {
+	db := newTestDriver(t, nil)
+	writeEmployees(t, db)
+
+	cached, err := New(db.Dir(), &Options{CacheSize: 4})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	n, err := cached.WarmCache("users")
+	if err != nil || n != 4 {
+		t.Fatalf("WarmCache = %d, %v, want 4 with a cache of 4", n, err)
+	}
+
+	reads := &countingStorage{}
+	cached.storage = reads
+	// Records are warmed in name order: Eren, Erwin, Johan, Maximilian.
+	for _, name := range []string{"Eren", "Erwin", "Johan", "Maximilian"} {
+		var u User
+		if err := cached.Read("users", name, &u); err != nil || u.Name != name {
+			t.Errorf("Read %s = %+v, %v", name, u, err)
+		}
+	}
+	if reads.reads != 0 {
+		t.Errorf("reads after WarmCache went to disk %d times, want none", reads.reads)
+	}
+
+	if n, err := db.WarmCache("users"); err != nil || n != 0 {
+		t.Errorf("WarmCache without a cache = %d, %v, want 0", n, err)
+	}
+}
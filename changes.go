@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+)
+
+// changeLogFile holds the change log, one JSON encoded Change per line,
+// in the database directory.
+const changeLogFile = "_changes.log"
+
+var errNoChangeLog = errors.New("change log is not enabled")
+
+// Change is one entry of the change log. Data holds the record's stored
+// bytes after a write and Hash their SHA-256, as reported by RecordHash.
+// Resource is empty when a whole collection was deleted.
+type Change struct {
+	Seq        uint64 `json:"seq"`
+	Op         string `json:"op"`
+	Collection string `json:"collection"`
+	Resource   string `json:"resource,omitempty"`
+	Data       []byte `json:"data,omitempty"`
+	Hash       string `json:"hash,omitempty"`
+}
+
+// archivedFile records, in the database directory, the sequence number of
+// the last change ArchiveChangeLog moved out of the log.
+const archivedFile = "_archived.json"
+
+// openChangeLog picks up the sequence where an existing log left off, or
+// where the last archive did if it has since been emptied.
+func (d *Driver) openChangeLog() error {
+	d.changeMutex.Lock()
+	defer d.changeMutex.Unlock()
+
+	seq, err := d.readSeqState(archivedFile)
+	if err != nil {
+		return err
+	}
+	d.seq = seq
+
+	return d.scanChanges(0, func(c Change) error {
+		d.seq = c.Seq
+		return nil
+	})
+}
+
+// logChange appends an entry to the change log when it is enabled.
+func (d *Driver) logChange(op Op, collection, resource string, data []byte) error {
+	if !d.changeLog {
+		return nil
+	}
+
+	c := Change{Op: op.String(), Collection: collection, Resource: resource}
+	if op == OpWrite {
+		c.Data, c.Hash = data, hashBytes(data)
+	}
+
+	d.changeMutex.Lock()
+	defer d.changeMutex.Unlock()
+
+	c.Seq = d.seq + 1
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(d.Dir(), changeLogFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, d.fileMode())
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+
+	if d.durable {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	d.seq = c.Seq
+	return nil
+}
+
+// Changes returns the entries of the change log with a sequence number
+// greater than since, oldest first.
+func (d *Driver) Changes(since uint64) ([]Change, error) {
+	if !d.changeLog {
+		return nil, errNoChangeLog
+	}
+
+	d.changeMutex.Lock()
+	defer d.changeMutex.Unlock()
+
+	var changes []Change
+	err := d.scanChanges(since, func(c Change) error {
+		changes = append(changes, c)
+		return nil
+	})
+
+	return changes, err
+}
+
+// DiffVersions compares two versions of a record, numbered from 1 in the
+// order the change log holds its writes, and returns the old and new
+// value of every top-level field that differs. A field missing from one
+// version is reported as nil there. Versions archived by ArchiveChangeLog
+// are no longer counted.
+func (d *Driver) DiffVersions(collection, resource string, v1, v2 int) (map[string][2]interface{}, error) {
+	if !d.changeLog {
+		return nil, errNoChangeLog
+	}
+
+	d.changeMutex.Lock()
+	var versions [][]byte
+	err := d.scanChanges(0, func(c Change) error {
+		if c.Op == OpWrite.String() && c.Collection == collection && c.Resource == resource {
+			versions = append(versions, c.Data)
+		}
+		return nil
+	})
+	d.changeMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	docs := make([]map[string]interface{}, 2)
+	for i, v := range []int{v1, v2} {
+		if v < 1 || v > len(versions) {
+			return nil, fmt.Errorf("%s/%s has no version %d: %w", collection, resource, v, ErrRecordNotFound)
+		}
+
+		b, err := d.plain(collection, versions[v-1])
+		if err != nil {
+			return nil, err
+		}
+		if err := d.codec.Unmarshal(b, &docs[i]); err != nil {
+			return nil, fmt.Errorf("unable to decode version %d of %s/%s: %w", v, collection, resource, err)
+		}
+	}
+
+	diff := make(map[string][2]interface{})
+	for field, was := range docs[0] {
+		if now, ok := docs[1][field]; !ok || !reflect.DeepEqual(was, now) {
+			diff[field] = [2]interface{}{was, now}
+		}
+	}
+	for field, now := range docs[1] {
+		if _, ok := docs[0][field]; !ok {
+			diff[field] = [2]interface{}{nil, now}
+		}
+	}
+
+	return diff, nil
+}
+
+// ExportChanges writes the entries of the change log after since to w, one
+// JSON object per line, in a form ApplyChanges can replay.
+func (d *Driver) ExportChanges(since uint64, w io.Writer) error {
+	if !d.changeLog {
+		return errNoChangeLog
+	}
+
+	d.changeMutex.Lock()
+	defer d.changeMutex.Unlock()
+
+	enc := json.NewEncoder(w)
+	return d.scanChanges(since, func(c Change) error {
+		return enc.Encode(c)
+	})
+}
+
+// ArchiveChangeLog writes the change log's entries up to and including
+// upTo to w, in ExportChanges' form, then removes them from the log. Later
+// entries stay, and sequence numbers carry on from where they were. The
+// log is left as it was if writing to w fails.
+func (d *Driver) ArchiveChangeLog(w io.Writer, upTo uint64) error {
+	if !d.changeLog {
+		return errNoChangeLog
+	}
+
+	d.changeMutex.Lock()
+	defer d.changeMutex.Unlock()
+
+	var kept bytes.Buffer
+	archive, keep := json.NewEncoder(w), json.NewEncoder(&kept)
+	if err := d.scanChanges(0, func(c Change) error {
+		if c.Seq <= upTo {
+			return archive.Encode(c)
+		}
+		return keep.Encode(c)
+	}); err != nil {
+		return err
+	}
+
+	// The mark only moves forward, so an earlier archive's entries can't
+	// have their sequence numbers handed out again on reopening.
+	archived, err := d.readSeqState(archivedFile)
+	if err != nil {
+		return err
+	}
+	if upTo > d.seq {
+		upTo = d.seq
+	}
+	if upTo < archived {
+		upTo = archived
+	}
+	if err := d.writeSeqState(archivedFile, upTo); err != nil {
+		return err
+	}
+
+	return d.writeFile(filepath.Join(d.Dir(), changeLogFile), kept.Bytes())
+}
+
+// scanChanges calls fn for each logged change after since. The caller must
+// hold changeMutex.
+func (d *Driver) scanChanges(since uint64, fn func(Change) error) error {
+	f, err := os.Open(filepath.Join(d.Dir(), changeLogFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return decodeChanges(f, func(c Change) error {
+		if c.Seq <= since {
+			return nil
+		}
+		return fn(c)
+	})
+}
+
+func decodeChanges(r io.Reader, fn func(Change) error) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var c Change
+		if err := dec.Decode(&c); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("unable to read change log: %w", err)
+		}
+
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+}
+
+// appliedFile records, in the database directory, the sequence number of
+// the last change ApplyChanges replayed.
+const appliedFile = "_applied.json"
+
+// ApplyChanges replays changes written by ExportChanges, typically from
+// another Driver using the same Codec, and returns how many of them
+// changed this database. Replaying is idempotent: changes at or below the
+// last sequence number applied before are skipped, as are writes whose
+// record already has the logged hash and deletes of records that are
+// already gone. The sequence is remembered per database, so all changes
+// applied to one Driver should come from the same source.
+func (d *Driver) ApplyChanges(r io.Reader) (applied int, err error) {
+	if err := d.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	d.applyMutex.Lock()
+	defer d.applyMutex.Unlock()
+
+	last, err := d.lastApplied()
+	if err != nil {
+		return 0, err
+	}
+
+	err = decodeChanges(r, func(c Change) error {
+		if c.Seq <= last {
+			return nil
+		}
+
+		ok, err := d.applyChange(c)
+		if err != nil {
+			return err
+		}
+		if ok {
+			applied++
+		}
+
+		last = c.Seq
+		return d.setLastApplied(last)
+	})
+
+	return applied, err
+}
+
+func (d *Driver) lastApplied() (uint64, error) {
+	return d.readSeqState(appliedFile)
+}
+
+func (d *Driver) setLastApplied(seq uint64) error {
+	return d.writeSeqState(appliedFile, seq)
+}
+
+// readSeqState reads a sequence number kept in the named file of the
+// database directory, returning 0 when the file doesn't exist.
+func (d *Driver) readSeqState(name string) (uint64, error) {
+	b, err := ioutil.ReadFile(filepath.Join(d.Dir(), name))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var state struct {
+		Seq uint64 `json:"seq"`
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return 0, fmt.Errorf("unable to read %s: %w", name, err)
+	}
+
+	return state.Seq, nil
+}
+
+func (d *Driver) writeSeqState(name string, seq uint64) error {
+	b, err := marshal(map[string]uint64{"seq": seq})
+	if err != nil {
+		return err
+	}
+
+	return d.writeFile(filepath.Join(d.Dir(), name), b)
+}
+
+func (d *Driver) applyChange(c Change) (bool, error) {
+	if c.Collection == "" {
+		return false, fmt.Errorf("change %d has no collection", c.Seq)
+	}
+
+	unlock := d.lockDelete(c.Collection)
+	defer unlock()
+
+	switch c.Op {
+	case OpWrite.String():
+		if c.Resource == "" {
+			return false, fmt.Errorf("change %d has no resource", c.Seq)
+		}
+		if err := d.checkResource(c.Resource); err != nil {
+			return false, fmt.Errorf("change %d: %w", c.Seq, err)
+		}
+
+		if err := d.checkInput(fmt.Sprintf("change %d", c.Seq), c.Data); err != nil {
+			return false, err
+		}
+
+		if b, err := d.readRecordLocked(c.Collection, c.Resource); err == nil && hashBytes(b) == c.Hash {
+			return false, nil
+		}
+
+		return true, d.writeRecord(c.Collection, c.Resource, c.Data)
+
+	case OpDelete.String():
+		if c.Resource != "" {
+			if err := d.checkResource(c.Resource); err != nil {
+				return false, fmt.Errorf("change %d: %w", c.Seq, err)
+			}
+		}
+		if _, err := d.stat(filepath.Join(d.Dir(), c.Collection, c.Resource)); os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return true, d.deleteLocked(c.Collection, c.Resource)
+	}
+
+	return false, fmt.Errorf("change %d has unknown op %q", c.Seq, c.Op)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyChangesSyncsAnotherDriver(t *testing.T) {
+	src := newTestDriver(t, &Options{ChangeLog: true})
+	dst := newTestDriver(t, nil)
+
+	if err := src.Write("users", "Eren", User{Name: "Eren"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := src.Write("users", "Johan", User{Name: "Johan"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := src.Delete("users", "Eren"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := src.ExportChanges(0, &buf); err != nil {
+		t.Fatalf("ExportChanges: %v", err)
+	}
+	exported := buf.Bytes()
+
+	applied, err := dst.ApplyChanges(bytes.NewReader(exported))
+	if err != nil {
+		t.Fatalf("ApplyChanges: %v", err)
+	}
+	if applied != 3 {
+		t.Errorf("applied = %d, want 3", applied)
+	}
+
+	applied, err = dst.ApplyChanges(bytes.NewReader(exported))
+	if err != nil {
+		t.Fatalf("ApplyChanges again: %v", err)
+	}
+	if applied != 0 {
+		t.Errorf("replaying applied %d changes, want 0", applied)
+	}
+
+	var u User
+	if err := dst.Read("users", "Johan", &u); err != nil || u.Name != "Johan" {
+		t.Errorf("Read Johan = %+v, %v", u, err)
+	}
+	if err := dst.Read("users", "Eren", &u); err == nil {
+		t.Error("deleted record Eren exists on the target")
+	}
+
+	srcDigest, err := src.Digest()
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+	dstDigest, err := dst.Digest()
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+	if srcDigest != dstDigest {
+		t.Error("source and target differ after syncing")
+	}
+}
+
+func TestChangeLogSequenceSurvivesReopen(t *testing.T) {
+	db := newTestDriver(t, &Options{ChangeLog: true})
+
+	for _, name := range []string{"a", "b"} {
+		if err := db.Write("users", name, User{Name: name}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	reopened, err := New(db.Dir(), &Options{ChangeLog: true})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := reopened.Write("users", "c", User{Name: "c"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	changes, err := reopened.Changes(1)
+	if err != nil {
+		t.Fatalf("Changes: %v", err)
+	}
+	if len(changes) != 2 || changes[0].Seq != 2 || changes[1].Seq != 3 {
+		t.Errorf("Changes(1) = %+v, want sequences 2 and 3", changes)
+	}
+}
+
+func TestArchiveChangeLog(t *testing.T) {
+	db := newTestDriver(t, &Options{ChangeLog: true})
+
+	for _, name := range []string{"a", "b", "c"} {
+		if err := db.Write("users", name, User{Name: name}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	var archive bytes.Buffer
+	if err := db.ArchiveChangeLog(&archive, 2); err != nil {
+		t.Fatalf("ArchiveChangeLog: %v", err)
+	}
+
+	var archived []uint64
+	if err := decodeChanges(&archive, func(c Change) error {
+		archived = append(archived, c.Seq)
+		return nil
+	}); err != nil {
+		t.Fatalf("reading archive: %v", err)
+	}
+	if len(archived) != 2 || archived[0] != 1 || archived[1] != 2 {
+		t.Errorf("archived sequences = %v, want [1 2]", archived)
+	}
+
+	changes, err := db.Changes(0)
+	if err != nil {
+		t.Fatalf("Changes: %v", err)
+	}
+	if len(changes) != 1 || changes[0].Seq != 3 || changes[0].Resource != "c" {
+		t.Errorf("Changes(0) after archiving = %+v, want only c at 3", changes)
+	}
+
+	// Archiving everything must not let a reopened log reuse sequences.
+	if err := db.ArchiveChangeLog(ioutil.Discard, 3); err != nil {
+		t.Fatalf("ArchiveChangeLog: %v", err)
+	}
+	reopened, err := New(db.Dir(), &Options{ChangeLog: true})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := reopened.Write("users", "d", User{Name: "d"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if changes, err = reopened.Changes(0); err != nil || len(changes) != 1 || changes[0].Seq != 4 {
+		t.Errorf("Changes(0) after reopening = %+v, %v, want d at 4", changes, err)
+	}
+}
+
+func TestArchiveChangeLogMarkOnlyMovesForward(t *testing.T) {
+	db := newTestDriver(t, &Options{ChangeLog: true})
+
+	for i := 0; i < 10; i++ {
+		if err := db.Write("users", fmt.Sprint(i), User{Name: fmt.Sprint(i)}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	if err := db.ArchiveChangeLog(ioutil.Discard, 10); err != nil {
+		t.Fatalf("ArchiveChangeLog: %v", err)
+	}
+	if err := db.ArchiveChangeLog(ioutil.Discard, 3); err != nil {
+		t.Fatalf("ArchiveChangeLog: %v", err)
+	}
+
+	reopened, err := New(db.Dir(), &Options{ChangeLog: true})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := reopened.Write("users", "next", User{Name: "next"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if changes, err := reopened.Changes(0); err != nil || len(changes) != 1 || changes[0].Seq != 11 {
+		t.Errorf("Changes(0) after reopening = %+v, %v, want next at 11", changes, err)
+	}
+}
+
+func TestDiffVersions(t *testing.T) {
+	db := newTestDriver(t, &Options{ChangeLog: true})
+
+	if err := db.Write("users", "Eren", User{Name: "Eren", Age: "19", Company: "Scouts"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := db.Write("users", "Mikasa", User{Name: "Mikasa"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := db.Write("users", "Eren", User{Name: "Eren", Age: "20", Company: "Scouts"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	diff, err := db.DiffVersions("users", "Eren", 1, 2)
+	if err != nil {
+		t.Fatalf("DiffVersions: %v", err)
+	}
+	want := map[string][2]interface{}{"Age": {float64(19), float64(20)}}
+	if !reflect.DeepEqual(diff, want) {
+		t.Errorf("DiffVersions = %v, want %v", diff, want)
+	}
+
+	if _, err := db.DiffVersions("users", "Eren", 1, 3); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("DiffVersions of a missing version = %v, want ErrRecordNotFound", err)
+	}
+}
+
+func TestChangesRequiresChangeLog(t *testing.T) {
+	db := newTestDriver(t, nil)
+
+	if _, err := db.Changes(0); err == nil {
+		t.Error("Changes succeeded without ChangeLog")
+	}
+}
+
+func TestApplyChangesInputLimits(t *testing.T) {
+	src := newTestDriver(t, &Options{ChangeLog: true})
+	dst := newTestDriver(t, &Options{MaxInputBytes: 256})
+
+	if err := src.Write("users", "Eren", User{Name: strings.Repeat("a", 512)}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := src.ExportChanges(0, &buf); err != nil {
+		t.Fatalf("ExportChanges: %v", err)
+	}
+	if _, err := dst.ApplyChanges(&buf); !errors.Is(err, ErrInputTooComplex) {
+		t.Errorf("ApplyChanges of an oversized record = %v, want ErrInputTooComplex", err)
+	}
+}
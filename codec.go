@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+)
+
+// Codec converts records to and from the bytes stored on disk. Ext is the
+// file extension, including the leading dot, given to records it encodes.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+	Ext() string
+}
+
+// SelfMarshaler is implemented by types that choose their own on-disk form.
+// When the value passed to Write or Read implements it, the Driver's Codec,
+// field mapping and CanonicalJSON are bypassed and the record's bytes are
+// exactly what MarshalRecord returned, compressed only if they exceed
+// CompressOverBytes. A value whose methods have pointer receivers may be
+// passed to Write as is.
+type SelfMarshaler interface {
+	MarshalRecord() ([]byte, error)
+	UnmarshalRecord([]byte) error
+}
+
+// JSONCodec stores records as indented JSON. It is the default Codec.
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (JSONCodec) Ext() string {
+	return ".json"
+}
+
+// GobCodec stores records with encoding/gob, which is faster than JSON and
+// keeps Go types intact when both writer and reader are Go programs.
+//
+// gob needs concrete types: Read must be given a pointer to the type that
+// was written, and any value stored in an interface field must have been
+// registered with gob.Register. Records can't be decoded into a generic
+// map the way JSON records can, and features that inspect record contents
+// as JSON have no effect, such as SetFieldMap, or fail, such as SetUnique
+// and CreateIndex.
+type GobCodec struct{}
+
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (GobCodec) Ext() string {
+	return ".gob"
+}
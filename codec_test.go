@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGobCodecRoundTrip(t *testing.T) {
+	db := newTestDriver(t, &Options{Codec: GobCodec{}})
+
+	want := User{Name: "Erwin", Age: "33", Company: "Fidelity", Address: Address{City: "Pune", Country: "india"}}
+	if err := db.Write("users", "Erwin", want); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(db.Dir(), "users", "Erwin.gob")); err != nil {
+		t.Errorf("record not stored with the .gob extension: %v", err)
+	}
+
+	var got User
+	if err := db.Read("users", "Erwin", &got); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if got != want {
+		t.Errorf("Read = %+v, want %+v", got, want)
+	}
+}
+
+// point stores itself as two raw bytes, the first of which is the first
+// byte of the gzip header.
+type point struct {
+	X, Y byte
+}
+
+func (p *point) MarshalRecord() ([]byte, error) {
+	return []byte{0x1f, p.X, p.Y}, nil
+}
+
+func (p *point) UnmarshalRecord(b []byte) error {
+	if len(b) != 3 || b[0] != 0x1f {
+		return fmt.Errorf("bad point %x", b)
+	}
+	p.X, p.Y = b[1], b[2]
+	return nil
+}
+
+// tagged only implements half of SelfMarshaler.
+type tagged struct {
+	Name string
+}
+
+func (tagged) MarshalRecord() ([]byte, error) {
+	return []byte("custom"), nil
+}
+
+func TestSelfMarshaler(t *testing.T) {
+	db := newTestDriver(t, &Options{CompressOverBytes: 1})
+
+	want := point{X: 0x8b, Y: 7}
+	if err := db.Write("points", "p", want); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	var got point
+	if err := db.Read("points", "p", &got); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if got != want {
+		t.Errorf("Read = %+v, want %+v", got, want)
+	}
+
+	points, err := ReadAllTyped[point](db, "points")
+	if err != nil {
+		t.Fatalf("ReadAllTyped: %v", err)
+	}
+	if len(points) != 1 || points[0] != want {
+		t.Errorf("ReadAllTyped = %+v, want [%+v]", points, want)
+	}
+}
+
+func TestSelfMarshalerBytesLandOnDisk(t *testing.T) {
+	db := newTestDriver(t, nil)
+
+	if err := db.Write("points", "p", &point{X: 0x8b, Y: 7}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(db.Dir(), "points", "p.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, []byte{0x1f, 0x8b, 7}) {
+		t.Errorf("on-disk bytes = %x, want 1f8b07", b)
+	}
+
+	var got point
+	if err := db.Read("points", "p", &got); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if got.X != 0x8b || got.Y != 7 {
+		t.Errorf("Read = %+v", got)
+	}
+}
+
+func TestPartialSelfMarshalerUsesCodec(t *testing.T) {
+	db := newTestDriver(t, nil)
+
+	if err := db.Write("tags", "t", tagged{Name: "x"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	var got tagged
+	if err := db.Read("tags", "t", &got); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if got.Name != "x" {
+		t.Errorf("Read = %+v, want the codec round trip", got)
+	}
+}
+
+func TestSelfMarshalerRejectsFieldMap(t *testing.T) {
+	db := newTestDriver(t, nil)
+	db.SetFieldMap("points", map[string]string{"X": "x"})
+
+	if err := db.Write("points", "p", point{}); err == nil {
+		t.Error("Write of a SelfMarshaler into a field mapped collection succeeded")
+	}
+}
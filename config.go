@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// configFile holds, inside a collection's directory, the CollectionConfig
+// last passed to Configure. It is always JSON, whatever the Codec.
+const configFile = "_collection.json"
+
+// CollectionConfig is the per-collection format Configure persists. The
+// Codec is set for the whole database through Options.
+type CollectionConfig struct {
+	// FieldMap is applied as by SetFieldMap.
+	FieldMap map[string]string `json:"fieldMap,omitempty"`
+
+	// CompressOverBytes, if positive, replaces Options.CompressOverBytes
+	// for the collection. A negative value turns compression off for it.
+	CompressOverBytes int `json:"compressOverBytes,omitempty"`
+}
+
+// Configure applies config to the collection and saves it in the
+// collection's directory, so New applies it again when the database is
+// reopened. The config replaces any set before. Records already stored
+// are left as they are; Reencode rewrites them too.
+func (d *Driver) Configure(collection string, config CollectionConfig) error {
+	if collection == "" {
+		return fmt.Errorf("missing collection - no place to save config")
+	}
+
+	b, err := marshal(config)
+	if err != nil {
+		return err
+	}
+
+	return d.withTimeout(func() error {
+		mutex := d.lockCollection(collection)
+		defer mutex.Unlock()
+
+		if err := d.checkWritable(); err != nil {
+			return err
+		}
+
+		dir := filepath.Join(d.Dir(), collection)
+		if err := os.MkdirAll(dir, d.dirMode()); err != nil {
+			return err
+		}
+
+		if err := d.writeFile(filepath.Join(dir, configFile), b); err != nil {
+			return err
+		}
+
+		if d.durable {
+			if err := syncDir(dir); err != nil {
+				return err
+			}
+		}
+
+		d.applyConfig(collection, config)
+		return nil
+	})
+}
+
+// Reencode rewrites every record of the collection in the format config
+// describes and then saves config as Configure would. The records are
+// swapped in all at once, as by ReplaceCollection, together with the
+// config, so a failure leaves both the records and the config as they
+// were.
+func (d *Driver) Reencode(collection string, config CollectionConfig) error {
+	if collection == "" {
+		return fmt.Errorf("missing collection - no place to save records")
+	}
+
+	b, err := marshal(config)
+	if err != nil {
+		return err
+	}
+
+	return d.withTimeout(func() error {
+		mutex := d.lockCollection(collection)
+		defer mutex.Unlock()
+
+		if err := d.checkWritable(); err != nil {
+			return err
+		}
+
+		var resources []string
+		encoded := make(map[string][]byte)
+		err := d.eachRecord(collection, func(resource string, old []byte) error {
+			plain, err := d.plain(collection, old)
+			if err != nil {
+				return err
+			}
+
+			b := plain
+			if config.FieldMap != nil {
+				if b, err = renameFields(plain, config.FieldMap); err != nil {
+					return err
+				}
+			}
+			if _, ok := d.codec.(JSONCodec); ok && d.canonical {
+				if b, err = canonicalize(b); err != nil {
+					return err
+				}
+			}
+
+			resources = append(resources, resource)
+			encoded[resource] = b
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		previous := d.collectionConfig(collection)
+		d.applyConfig(collection, config)
+
+		if err := d.replaceCollection(collection, resources, encoded, b); err != nil {
+			d.applyConfig(collection, previous)
+			return err
+		}
+
+		return nil
+	})
+}
+
+// applyConfig sets up the collection as config describes, in memory only.
+func (d *Driver) applyConfig(collection string, config CollectionConfig) {
+	d.SetFieldMap(collection, config.FieldMap)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if config.CompressOverBytes == 0 {
+		delete(d.compressions, collection)
+	} else {
+		d.compressions[collection] = config.CompressOverBytes
+	}
+}
+
+// collectionConfig returns the config the collection is set up with.
+func (d *Driver) collectionConfig(collection string) CollectionConfig {
+	config := CollectionConfig{FieldMap: d.fieldMap(collection)}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	config.CompressOverBytes = d.compressions[collection]
+	return config
+}
+
+// compressThreshold returns the size over which the collection's records
+// are compressed, or 0 if they never are.
+func (d *Driver) compressThreshold(collection string) int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	switch n := d.compressions[collection]; {
+	case n > 0:
+		return n
+	case n < 0:
+		return 0
+	}
+	return d.compressOver
+}
+
+// loadConfigs applies the config saved by Configure for every collection.
+func (d *Driver) loadConfigs() error {
+	collections, err := d.collections()
+	if err != nil {
+		return err
+	}
+
+	for _, collection := range collections {
+		b, err := ioutil.ReadFile(filepath.Join(d.Dir(), collection, configFile))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		var config CollectionConfig
+		if err := json.Unmarshal(b, &config); err != nil {
+			return fmt.Errorf("unable to read %s of %s: %w", configFile, collection, err)
+		}
+		d.applyConfig(collection, config)
+	}
+
+	return nil
+}
+
+// collectionFiles are the internal files kept in a collection's directory.
+var collectionFiles = []string{configFile, seqFile}
+
+// copyCollectionFiles carries the internal files of the collection directory
+// from over into dir. A config, if given, is written in place of the saved
+// one.
+func (d *Driver) copyCollectionFiles(from, dir string, config []byte) error {
+	for _, name := range collectionFiles {
+		if name == configFile && config != nil {
+			if err := d.writeFile(filepath.Join(dir, name), config); err != nil {
+				return err
+			}
+			continue
+		}
+
+		b, err := ioutil.ReadFile(filepath.Join(from, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := d.writeFile(filepath.Join(dir, name), b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigureSurvivesRestart(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db")
+
+	db, err := New(dir, nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := db.Configure("users", CollectionConfig{FieldMap: map[string]string{"Name": "n"}}); err != nil {
+		t.Fatalf("Configure: %v", err)
+	}
+	if err := db.Write("users", "Eren", User{Name: "Eren", Company: "Domini"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := db.Write("users", "_collection", User{}); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Write over the config file = %v, want ErrInvalidKey", err)
+	}
+
+	reopened, err := New(dir, nil)
+	if err != nil {
+		t.Fatalf("New after restart: %v", err)
+	}
+	var u User
+	if err := reopened.Read("users", "Eren", &u); err != nil || u.Name != "Eren" {
+		t.Errorf("Read after restart = %+v, %v, want the field map applied", u, err)
+	}
+	if records, err := reopened.ReadAll("users"); err != nil || len(records) != 1 {
+		t.Errorf("ReadAll = %v, %v, want only the record", records, err)
+	}
+
+	err = reopened.ReplaceCollection("users", map[string]interface{}{"Mikasa": User{Name: "Mikasa"}})
+	if err != nil {
+		t.Fatalf("ReplaceCollection: %v", err)
+	}
+	again, err := New(dir, nil)
+	if err != nil {
+		t.Fatalf("New after ReplaceCollection: %v", err)
+	}
+	if err := again.Read("users", "Mikasa", &u); err != nil || u.Name != "Mikasa" {
+		t.Errorf("Read after ReplaceCollection = %+v, %v, want the config kept", u, err)
+	}
+}
+
+func TestReencodeToCompressed(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db")
+
+	db, err := New(dir, &Options{CacheSize: 10})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	writeEmployees(t, db)
+
+	config := CollectionConfig{FieldMap: map[string]string{"Company": "c"}, CompressOverBytes: 1}
+	if err := db.Reencode("users", config); err != nil {
+		t.Fatalf("Reencode: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "users", "Eren.json.gz")); err != nil {
+		t.Errorf("record not stored compressed after Reencode: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "users", "Eren.json")); !os.IsNotExist(err) {
+		t.Errorf("uncompressed record left behind: %v", err)
+	}
+	raw, err := db.readRecordFile(filepath.Join(dir, "users", "Eren.json.gz"))
+	if err != nil {
+		t.Fatalf("reading the compressed record: %v", err)
+	}
+	var stored map[string]interface{}
+	if err := json.Unmarshal(raw, &stored); err != nil || stored["c"] != "Domini" {
+		t.Errorf("stored record %s doesn't use the new field map", raw)
+	}
+
+	var u User
+	if err := db.Read("users", "Eren", &u); err != nil || u.Company != "Domini" {
+		t.Errorf("Read after Reencode = %+v, %v", u, err)
+	}
+	if err := db.Write("users", "Levi", User{Name: "Levi", Company: "Survey Corps"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "users", "Levi.json.gz")); err != nil {
+		t.Errorf("new record not compressed: %v", err)
+	}
+
+	reopened, err := New(dir, nil)
+	if err != nil {
+		t.Fatalf("New after restart: %v", err)
+	}
+	users, err := ReadAllTyped[User](reopened, "users")
+	if err != nil || len(users) != 7 {
+		t.Fatalf("ReadAllTyped after restart = %d users, %v", len(users), err)
+	}
+	for _, u := range users {
+		if u.Company == "" {
+			t.Errorf("%s lost its company after restart", u.Name)
+		}
+	}
+}
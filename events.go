@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Op int
+
+const (
+	OpWrite Op = iota + 1
+	OpDelete
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpWrite:
+		return "write"
+	case OpDelete:
+		return "delete"
+	}
+	return "unknown"
+}
+
+// Event describes a change made through the Driver. Resource is empty when
+// a whole collection was deleted.
+type Event struct {
+	Op         Op
+	Collection string
+	Resource   string
+}
+
+type watcher struct {
+	collection string
+	resource   string
+	ch         chan Event
+	log        Logger
+	window     time.Duration
+
+	mutex   sync.Mutex
+	closed  bool
+	pending []Event
+	timer   *time.Timer
+}
+
+// watchBuffer is how many events a watcher may fall behind by before new
+// events for it are dropped.
+const watchBuffer = 64
+
+// WatchResource returns a channel receiving the events that affect one
+// resource, including deletion of its whole collection, and a function to
+// stop watching. Only changes made through this Driver are reported. Events
+// are dropped rather than blocking writers if the receiver falls behind.
+func (d *Driver) WatchResource(collection, resource string) (<-chan Event, func()) {
+	return d.watch(collection, strings.TrimSuffix(resource, d.codec.Ext()))
+}
+
+// Tail returns a channel that first receives a write event for every
+// record the collection holds and then the events of changes made to it
+// through this Driver, until ctx is done and the channel is closed. The
+// records are listed and the watch started under the collection's lock,
+// so no change is missed or reported twice. Like WatchResource, live
+// events are dropped if the receiver falls behind.
+func (d *Driver) Tail(ctx context.Context, collection string) (<-chan Event, error) {
+	if collection == "" {
+		return nil, fmt.Errorf("missing collection - no place to read record")
+	}
+
+	mutex := d.lockCollection(collection)
+	var existing []string
+	err := d.eachRecordFile(collection, func(resource, path string, fi os.FileInfo) error {
+		existing = append(existing, resource)
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		mutex.Unlock()
+		return nil, err
+	}
+	events, cancel := d.watch(collection, "")
+	mutex.Unlock()
+
+	out := make(chan Event)
+	go func() {
+		defer close(out)
+		defer cancel()
+
+		for _, resource := range existing {
+			select {
+			case out <- Event{Op: OpWrite, Collection: collection, Resource: resource}:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		for {
+			select {
+			case ev := <-events:
+				select {
+				case out <- ev:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+func (d *Driver) watch(collection, resource string) (<-chan Event, func()) {
+	w := &watcher{
+		collection: collection,
+		resource:   resource,
+		ch:         make(chan Event, watchBuffer),
+		log:        d.log,
+		window:     d.coalesce,
+	}
+
+	d.watchMutex.Lock()
+	d.watchers[w] = struct{}{}
+	d.watchMutex.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			d.watchMutex.Lock()
+			delete(d.watchers, w)
+			d.watchMutex.Unlock()
+			w.close()
+		})
+	}
+
+	return w.ch, cancel
+}
+
+func (d *Driver) notify(op Op, collection, resource string) {
+	ev := Event{Op: op, Collection: collection, Resource: strings.TrimSuffix(resource, d.codec.Ext())}
+
+	d.watchMutex.Lock()
+	defer d.watchMutex.Unlock()
+
+	for w := range d.watchers {
+		if w.matches(ev) {
+			w.deliver(ev)
+		}
+	}
+}
+
+// deliver sends ev to the watcher, or with coalescing enabled queues it to
+// be sent once the window since the first queued event has passed. A
+// queued event for the same resource is replaced by ev.
+func (w *watcher) deliver(ev Event) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return
+	}
+
+	if w.window <= 0 {
+		w.send(ev)
+		return
+	}
+
+	for i, queued := range w.pending {
+		if queued.Collection == ev.Collection && queued.Resource == ev.Resource {
+			w.pending = append(append(w.pending[:i:i], w.pending[i+1:]...), ev)
+			return
+		}
+	}
+	w.pending = append(w.pending, ev)
+
+	if w.timer == nil {
+		w.timer = time.AfterFunc(w.window, w.flush)
+	}
+}
+
+func (w *watcher) flush() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return
+	}
+
+	for _, ev := range w.pending {
+		w.send(ev)
+	}
+	w.pending, w.timer = nil, nil
+}
+
+// send must be called with w.mutex held.
+func (w *watcher) send(ev Event) {
+	select {
+	case w.ch <- ev:
+	default:
+		w.log.Warn("Dropping %s event for %s/%s: watcher is not keeping up", ev.Op, ev.Collection, ev.Resource)
+	}
+}
+
+func (w *watcher) close() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.closed = true
+	close(w.ch)
+}
+
+func (w *watcher) matches(ev Event) bool {
+	if w.collection != "" && w.collection != ev.Collection {
+		return false
+	}
+
+	return w.resource == "" || ev.Resource == "" || w.resource == ev.Resource
+}
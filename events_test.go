@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// nextEvent waits briefly for an event on ch.
+func nextEvent(t *testing.T, ch <-chan Event) (Event, bool) {
+	t.Helper()
+
+	select {
+	case ev, ok := <-ch:
+		return ev, ok
+	case <-time.After(time.Second):
+		return Event{}, false
+	}
+}
+
+func TestWatchResourceIgnoresOtherResources(t *testing.T) {
+	db := newTestDriver(t, nil)
+
+	ch, cancel := db.WatchResource("users", "Eren")
+	defer cancel()
+
+	if err := db.Write("users", "Mikasa", User{Name: "Mikasa"}); err != nil {
+		t.Fatalf("Write Mikasa: %v", err)
+	}
+	if err := db.Write("orders", "Eren", User{Name: "Eren"}); err != nil {
+		t.Fatalf("Write orders/Eren: %v", err)
+	}
+	if err := db.Write("users", "Eren", User{Name: "Eren"}); err != nil {
+		t.Fatalf("Write Eren: %v", err)
+	}
+	if err := db.Delete("users", "Eren"); err != nil {
+		t.Fatalf("Delete Eren: %v", err)
+	}
+
+	for _, want := range []Event{
+		{Op: OpWrite, Collection: "users", Resource: "Eren"},
+		{Op: OpDelete, Collection: "users", Resource: "Eren"},
+	} {
+		ev, ok := nextEvent(t, ch)
+		if !ok {
+			t.Fatalf("no event, want %+v", want)
+		}
+		if ev != want {
+			t.Errorf("event = %+v, want %+v", ev, want)
+		}
+	}
+
+	select {
+	case ev := <-ch:
+		t.Errorf("unexpected event %+v", ev)
+	default:
+	}
+}
+
+func TestWatchResourceCancelClosesChannel(t *testing.T) {
+	db := newTestDriver(t, nil)
+
+	ch, cancel := db.WatchResource("users", "Eren")
+	cancel()
+	cancel()
+
+	if err := db.Write("users", "Eren", User{Name: "Eren"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, ok := <-ch; ok {
+		t.Error("channel delivered an event after cancel")
+	}
+}
+
+func TestCoalesceEvents(t *testing.T) {
+	db := newTestDriver(t, &Options{CoalesceEvents: 50 * time.Millisecond})
+
+	ch, cancel := db.WatchResource("users", "Eren")
+	defer cancel()
+
+	for i := 0; i < 10; i++ {
+		if err := db.Write("users", "Eren", User{Name: "Eren"}); err != nil {
+			t.Fatalf("Write %d: %v", i, err)
+		}
+	}
+
+	ev, ok := nextEvent(t, ch)
+	if !ok {
+		t.Fatal("no coalesced event")
+	}
+	if want := (Event{Op: OpWrite, Collection: "users", Resource: "Eren"}); ev != want {
+		t.Errorf("event = %+v, want %+v", ev, want)
+	}
+
+	select {
+	case ev := <-ch:
+		t.Errorf("got a second event %+v, want the writes coalesced into one", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestTail(t *testing.T) {
+	db := newTestDriver(t, nil)
+	for _, name := range []string{"Eren", "Mikasa"} {
+		if err := db.Write("users", name, User{Name: name}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := db.Tail(ctx, "users")
+	if err != nil {
+		t.Fatalf("Tail: %v", err)
+	}
+
+	if err := db.Write("users", "Levi", User{Name: "Levi"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := db.Delete("users", "Eren"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	for _, want := range []Event{
+		{Op: OpWrite, Collection: "users", Resource: "Eren"},
+		{Op: OpWrite, Collection: "users", Resource: "Mikasa"},
+		{Op: OpWrite, Collection: "users", Resource: "Levi"},
+		{Op: OpDelete, Collection: "users", Resource: "Eren"},
+	} {
+		if ev, ok := nextEvent(t, ch); !ok || ev != want {
+			t.Fatalf("event = %+v, %v, want %+v", ev, ok, want)
+		}
+	}
+
+	cancel()
+	for range ch {
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+var ErrUniqueViolation = errors.New("unique constraint violated")
+
+// index maps the values one field takes across a collection to the
+// resources holding them. Indexes live in memory and are guarded by their
+// collection's mutex.
+type index struct {
+	unique    bool
+	resources map[string]map[string]struct{}
+	values    map[string]string
+}
+
+func newIndex(unique bool) *index {
+	return &index{
+		unique:    unique,
+		resources: make(map[string]map[string]struct{}),
+		values:    make(map[string]string),
+	}
+}
+
+func (ix *index) add(resource, value string) {
+	ix.remove(resource)
+
+	set, ok := ix.resources[value]
+	if !ok {
+		set = make(map[string]struct{})
+		ix.resources[value] = set
+	}
+	set[resource] = struct{}{}
+	ix.values[resource] = value
+}
+
+func (ix *index) remove(resource string) {
+	value, ok := ix.values[resource]
+	if !ok {
+		return
+	}
+
+	delete(ix.values, resource)
+	delete(ix.resources[value], resource)
+	if len(ix.resources[value]) == 0 {
+		delete(ix.resources, value)
+	}
+}
+
+func (ix *index) reset() {
+	ix.resources = make(map[string]map[string]struct{})
+	ix.values = make(map[string]string)
+}
+
+// owner returns a resource other than resource that already holds value.
+func (ix *index) owner(value, resource string) (string, bool) {
+	for other := range ix.resources[value] {
+		if other != resource {
+			return other, true
+		}
+	}
+	return "", false
+}
+
+// SetUnique requires every record in the collection to have a distinct
+// value for field, which may be a dotted path such as "Address.City".
+// Existing records are indexed first, and an error is returned if they
+// already contain duplicates. From then on a write whose field value is
+// held by a different resource fails with ErrUniqueViolation. Records
+// without the field are not constrained. Only JSON records can be indexed.
+func (d *Driver) SetUnique(collection, field string) error {
+	return d.createIndex(collection, field, true)
+}
+
+// CreateIndex indexes field, which may be a dotted path such as
+// "Address.City", over the collection so FindByIndex can look records up
+// by its value. The index is kept up to date by Write and Delete. Only
+// JSON records can be indexed.
+func (d *Driver) CreateIndex(collection, field string) error {
+	return d.createIndex(collection, field, false)
+}
+
+func (d *Driver) createIndex(collection, field string, unique bool) error {
+	if collection == "" {
+		return fmt.Errorf("missing collection - no place to index records")
+	}
+	if field == "" {
+		return fmt.Errorf("missing field - unable to index records")
+	}
+	if _, ok := d.codec.(JSONCodec); !ok {
+		return fmt.Errorf("unable to index %s - records stored with %T can't be inspected as JSON", field, d.codec)
+	}
+
+	mutex := d.lockCollection(collection)
+	defer mutex.Unlock()
+
+	if ix, ok := d.collectionIndexes(collection)[field]; ok && ix.unique && !unique {
+		return nil
+	}
+
+	ix, err := d.buildIndex(collection, field, unique)
+	if err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.indexes[collection] == nil {
+		d.indexes[collection] = make(map[string]*index)
+	}
+	d.indexes[collection][field] = ix
+
+	return nil
+}
+
+// FindByIndex returns, in name order, the resources whose indexed field
+// equals value.
+func (d *Driver) FindByIndex(collection, field string, value interface{}) ([]string, error) {
+	key, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	mutex := d.lockCollection(collection)
+	defer mutex.Unlock()
+
+	ix, ok := d.collectionIndexes(collection)[field]
+	if !ok {
+		return nil, fmt.Errorf("no index on %s in collection %s", field, collection)
+	}
+
+	var resources []string
+	for resource := range ix.resources[string(key)] {
+		resources = append(resources, resource)
+	}
+	sort.Strings(resources)
+
+	return resources, nil
+}
+
+// PruneIndex drops the entries of the collection's index on field that
+// point at records which no longer exist, for example because a file was
+// removed behind the Driver's back, and returns how many were dropped.
+func (d *Driver) PruneIndex(collection, field string) (removed int, err error) {
+	mutex := d.lockCollection(collection)
+	defer mutex.Unlock()
+
+	ix, ok := d.collectionIndexes(collection)[field]
+	if !ok {
+		return 0, fmt.Errorf("no index on %s in collection %s", field, collection)
+	}
+
+	for resource := range ix.values {
+		_, _, err := d.recordFile(collection, resource)
+		if err == nil {
+			continue
+		}
+		if !os.IsNotExist(err) {
+			return removed, err
+		}
+
+		ix.remove(resource)
+		removed++
+	}
+
+	return removed, nil
+}
+
+// buildIndex indexes field over the records already in the collection.
+// The caller must hold the collection's mutex.
+func (d *Driver) buildIndex(collection, field string, unique bool) (*index, error) {
+	ix := newIndex(unique)
+
+	err := d.eachRecord(collection, func(resource string, b []byte) error {
+		value, ok := fieldValue(d.indexDoc(collection, b), field)
+		if !ok {
+			return nil
+		}
+
+		if other, taken := ix.owner(value, resource); unique && taken {
+			return fmt.Errorf("%w: %s %s is held by both %s and %s", ErrUniqueViolation, field, value, other, resource)
+		}
+		ix.add(resource, value)
+
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return ix, nil
+}
+
+// reindex builds fresh copies of the collection's indexes over records,
+// which are about to replace the collection's contents, failing if they
+// break a unique index. The caller must hold the collection's mutex.
+func (d *Driver) reindex(collection string, records map[string][]byte) (map[string]*index, error) {
+	indexes := make(map[string]*index)
+
+	for field, old := range d.collectionIndexes(collection) {
+		ix := newIndex(old.unique)
+		for resource, b := range records {
+			value, ok := fieldValue(d.indexDoc(collection, b), field)
+			if !ok {
+				continue
+			}
+
+			if other, taken := ix.owner(value, resource); ix.unique && taken {
+				return nil, fmt.Errorf("%w: %s %s is held by both %s and %s", ErrUniqueViolation, field, value, other, resource)
+			}
+			ix.add(resource, value)
+		}
+		indexes[field] = ix
+	}
+
+	return indexes, nil
+}
+
+func (d *Driver) collectionIndexes(collection string) map[string]*index {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.indexes[collection]
+}
+
+// checkIndexes verifies that storing b as resource keeps the collection's
+// unique indexes valid and returns the decoded record for updateIndexes.
+// The caller must hold the collection's mutex.
+func (d *Driver) checkIndexes(collection, resource string, b []byte) (map[string]interface{}, error) {
+	indexes := d.collectionIndexes(collection)
+	if len(indexes) == 0 {
+		return nil, nil
+	}
+
+	doc := d.indexDoc(collection, b)
+	for field, ix := range indexes {
+		if !ix.unique {
+			continue
+		}
+
+		value, ok := fieldValue(doc, field)
+		if !ok {
+			continue
+		}
+
+		if other, taken := ix.owner(value, resource); taken {
+			return nil, fmt.Errorf("%w: %s %s is already held by %s", ErrUniqueViolation, field, value, other)
+		}
+	}
+
+	return doc, nil
+}
+
+// updateIndexes records the field values of a newly stored record. The
+// caller must hold the collection's mutex.
+func (d *Driver) updateIndexes(collection, resource string, doc map[string]interface{}) {
+	for field, ix := range d.collectionIndexes(collection) {
+		if value, ok := fieldValue(doc, field); ok {
+			ix.add(resource, value)
+		} else {
+			ix.remove(resource)
+		}
+	}
+}
+
+// unindex drops a deleted resource, or every resource when the whole
+// collection was deleted, from the collection's indexes. The caller must
+// hold the collection's mutex.
+func (d *Driver) unindex(collection, resource string) {
+	for _, ix := range d.collectionIndexes(collection) {
+		if resource == "" {
+			ix.reset()
+			continue
+		}
+		ix.remove(strings.TrimSuffix(resource, d.codec.Ext()))
+	}
+}
+
+// indexDoc decodes a stored JSON record into a generic map for indexing.
+// Records that aren't objects yield nil and are left out of indexes.
+func (d *Driver) indexDoc(collection string, b []byte) map[string]interface{} {
+	b, err := d.plain(collection, b)
+	if err != nil {
+		return nil
+	}
+
+	var doc map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil
+	}
+
+	return doc
+}
+
+// fieldValue returns the JSON encoding of field in doc, which is how
+// values are compared in indexes. A dotted field names a value inside
+// nested objects.
+func fieldValue(doc map[string]interface{}, field string) (string, bool) {
+	v, ok := lookupField(doc, field)
+	if !ok || v == nil {
+		return "", false
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", false
+	}
+
+	return string(b), true
+}
+
+// lookupField follows a dotted path such as "Address.City" through nested
+// objects.
+func lookupField(doc map[string]interface{}, field string) (interface{}, bool) {
+	var v interface{} = doc
+	for _, name := range strings.Split(field, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		if v, ok = obj[name]; !ok {
+			return nil, false
+		}
+	}
+
+	return v, true
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSetUnique(t *testing.T) {
+	db := newTestDriver(t, nil)
+
+	if err := db.SetUnique("users", "Contact"); err != nil {
+		t.Fatalf("SetUnique: %v", err)
+	}
+
+	if err := db.Write("users", "Eren", User{Name: "Eren", Contact: "111"}); err != nil {
+		t.Fatalf("first insert: %v", err)
+	}
+	if err := db.Write("users", "Eren", User{Name: "Eren", Contact: "111", Company: "Domini"}); err != nil {
+		t.Errorf("rewriting the same resource: %v", err)
+	}
+
+	err := db.Write("users", "Mikasa", User{Name: "Mikasa", Contact: "111"})
+	if !errors.Is(err, ErrUniqueViolation) {
+		t.Fatalf("duplicate insert = %v, want ErrUniqueViolation", err)
+	}
+	var u User
+	if err := db.Read("users", "Mikasa", &u); err == nil {
+		t.Error("rejected record was written")
+	}
+
+	if err := db.Delete("users", "Eren"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := db.Write("users", "Mikasa", User{Name: "Mikasa", Contact: "111"}); err != nil {
+		t.Errorf("insert after the holder was deleted: %v", err)
+	}
+}
+
+func TestSetUniqueRejectsExistingDuplicates(t *testing.T) {
+	db := newTestDriver(t, nil)
+	writeEmployees(t, db)
+
+	if err := db.SetUnique("users", "Contact"); !errors.Is(err, ErrUniqueViolation) {
+		t.Errorf("SetUnique over duplicate contacts = %v, want ErrUniqueViolation", err)
+	}
+}
+
+func TestIndexRequiresJSONCodec(t *testing.T) {
+	db := newTestDriver(t, &Options{Codec: GobCodec{}})
+
+	if err := db.SetUnique("users", "Contact"); err == nil {
+		t.Error("SetUnique succeeded with GobCodec")
+	}
+	if err := db.CreateIndex("users", "Contact"); err == nil {
+		t.Error("CreateIndex succeeded with GobCodec")
+	}
+}
+
+func TestPruneIndex(t *testing.T) {
+	db := newTestDriver(t, nil)
+	writeEmployees(t, db)
+
+	if err := db.CreateIndex("users", "Company"); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+	if err := os.Remove(filepath.Join(db.Dir(), "users", "Eren.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := db.PruneIndex("users", "Company")
+	if err != nil {
+		t.Fatalf("PruneIndex: %v", err)
+	}
+	if removed != 1 {
+		t.Errorf("PruneIndex removed %d entries, want 1", removed)
+	}
+
+	found, err := db.FindByIndex("users", "Company", "Domini")
+	if err != nil {
+		t.Fatalf("FindByIndex: %v", err)
+	}
+	if len(found) != 0 {
+		t.Errorf("FindByIndex(Domini) = %v after pruning, want nothing", found)
+	}
+
+	if removed, err := db.PruneIndex("users", "Company"); err != nil || removed != 0 {
+		t.Errorf("second PruneIndex = %d, %v, want 0, nil", removed, err)
+	}
+}
+
+func TestIndexNestedField(t *testing.T) {
+	db := newTestDriver(t, nil)
+	writeEmployees(t, db)
+
+	if err := db.CreateIndex("users", "Address.Country"); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+
+	found, err := db.FindByIndex("users", "Address.Country", "india")
+	if err != nil {
+		t.Fatalf("FindByIndex: %v", err)
+	}
+	if !reflect.DeepEqual(found, []string{"Erwin", "Mikasa"}) {
+		t.Errorf("FindByIndex(india) = %v, want [Erwin Mikasa]", found)
+	}
+
+	if err := db.Write("users", "Levi", User{Name: "Levi", Address: Address{Country: "india"}}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := db.Write("users", "Mikasa", User{Name: "Mikasa", Address: Address{Country: "Japan"}}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	found, err = db.FindByIndex("users", "Address.Country", "india")
+	if err != nil {
+		t.Fatalf("FindByIndex: %v", err)
+	}
+	if !reflect.DeepEqual(found, []string{"Erwin", "Levi"}) {
+		t.Errorf("FindByIndex(india) after writes = %v, want [Erwin Levi]", found)
+	}
+}
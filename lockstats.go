@@ -0,0 +1,35 @@
+package main
+
+import "time"
+
+// LockStat sums up the waits for one collection's lock.
+type LockStat struct {
+	Acquisitions uint64
+	Wait         time.Duration
+}
+
+// LockStats returns, per collection, how often its lock was taken and how
+// long was spent waiting for it in all since the Driver was created. It is
+// empty unless Options.LockStats is set. With MutexStripes, collections
+// sharing a stripe also wait on each other's operations.
+func (d *Driver) LockStats() map[string]LockStat {
+	d.statsMutex.Lock()
+	defer d.statsMutex.Unlock()
+
+	stats := make(map[string]LockStat, len(d.stats))
+	for collection, stat := range d.stats {
+		stats[collection] = stat
+	}
+
+	return stats
+}
+
+func (d *Driver) recordLockWait(collection string, wait time.Duration) {
+	d.statsMutex.Lock()
+	defer d.statsMutex.Unlock()
+
+	stat := d.stats[collection]
+	stat.Acquisitions++
+	stat.Wait += wait
+	d.stats[collection] = stat
+}
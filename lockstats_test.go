@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockStats(t *testing.T) {
+	db := newTestDriver(t, &Options{LockStats: true})
+	for _, collection := range []string{"hot", "quiet"} {
+		if err := db.Write(collection, "a", 1); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	mutex := db.lockCollection("hot")
+	done := make(chan error)
+	go func() { done <- db.Write("hot", "a", 2) }()
+	time.Sleep(20 * time.Millisecond)
+	mutex.Unlock()
+	if err := <-done; err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	stats := db.LockStats()
+	if hot := stats["hot"]; hot.Acquisitions == 0 || hot.Wait < 10*time.Millisecond {
+		t.Errorf("contended collection stats = %+v, want a wait of at least 10ms", hot)
+	}
+	if quiet := stats["quiet"]; quiet.Acquisitions == 0 {
+		t.Errorf("uncontended collection stats = %+v, want acquisitions counted", quiet)
+	}
+
+	if stats := newTestDriver(t, nil).LockStats(); len(stats) != 0 {
+		t.Errorf("LockStats without the option = %v, want empty", stats)
+	}
+}
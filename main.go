@@ -1,12 +1,28 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/jcelliott/lumber"
 )
@@ -24,15 +40,241 @@ type (
 	}
 
 	Driver struct {
+		// metrics comes first to keep its counters 64-bit aligned for the
+		// atomic operations on them.
+		metrics metrics
+
 		mutex   sync.Mutex
 		mutexes map[string]*sync.Mutex
-		dir     string
-		log     Logger
+		stripes []sync.Mutex
+
+		maxOpen   int
+		openOrder *list.List
+		openItems map[string]*list.Element
+		pins      map[string]int
+
+		lockStats  bool
+		statsMutex sync.Mutex
+		stats      map[string]LockStat
+		dirMutex   sync.RWMutex
+		dir        string
+		log        Logger
+		durable    bool
+		codec      Codec
+		storage    storage
+		files      chan struct{}
+		stale      time.Duration
+		timeout    time.Duration
+
+		compressOver int
+		canonical    bool
+		rejectEmpty  bool
+		hierarchical bool
+		keepBackup   bool
+		detectCase   bool
+		backupConc   bool
+		maxReadAll   int
+		keyPolicy    KeyPolicy
+		maxInput     int
+		permMask     os.FileMode
+		maxDepth     int
+		cache        *cache
+		readOnly     int32
+		fieldMaps    map[string]map[string]string
+		compressions map[string]int
+
+		onDecodeError DecodeErrorHandler
+		transform     func(collection, resource string, v interface{}) (interface{}, error)
+		postRead      func(collection, resource string, v interface{}) error
+
+		indexes  map[string]map[string]*index
+		types    map[string]map[string]registeredType
+		defaults map[reflect.Type]interface{}
+
+		recordDefaults map[string]map[string]interface{}
+		schemas        map[string]Schema
+		references     map[string][]reference
+
+		versionMutex     sync.Mutex
+		versions         map[string]uint64
+		reservedVersions map[string]uint64
+
+		changeLog   bool
+		changeMutex sync.Mutex
+		seq         uint64
+		applyMutex  sync.Mutex
+
+		watchMutex sync.Mutex
+		watchers   map[*watcher]struct{}
+		coalesce   time.Duration
+
+		// beforeRename, if set, runs in writeFile once the temp file is
+		// complete and before it replaces path. Tests use it to act in
+		// the middle of a write.
+		beforeRename func(path string)
+
+		// beforeSync, if set, runs in FlushCollection before each path is
+		// fsynced. Tests use it to see what gets synced.
+		beforeSync func(path string)
 	}
 )
 
+var (
+	ErrEmpty          = errors.New("array record is empty")
+	ErrReadOnly       = errors.New("database is read-only")
+	ErrRecordNotFound = errors.New("record not found")
+	ErrEmptyRecord    = errors.New("record is empty")
+	ErrInvalidKey     = errors.New("invalid resource key")
+	ErrResultTooLarge = errors.New("result too large")
+	ErrInvalidName    = errors.New("resource name violates the key policy")
+
+	ErrInputTooComplex = errors.New("input too large or deeply nested")
+	ErrCaseCollision   = errors.New("resource name differs from an existing one only by case")
+	ErrDiskFull        = errors.New("no space left on device")
+)
+
 type Options struct {
 	Logger
+
+	// Durable fsyncs every written file and its collection directory
+	// before a write returns.
+	Durable bool
+
+	// Codec encodes records on disk. It defaults to JSONCodec.
+	Codec Codec
+
+	// StaleAfter, if set, makes Read log a warning when the record it
+	// returns was last written longer ago than this.
+	StaleAfter time.Duration
+
+	// CanonicalJSON sorts object keys at every level of JSON records,
+	// including struct fields, so equal data always produces byte for byte
+	// identical files.
+	CanonicalJSON bool
+
+	// CompressOverBytes, if set, gzips records whose encoded size exceeds
+	// this many bytes. Compressed records are stored with a ".gz" suffix
+	// after the codec's extension, which is how reads recognise them.
+	CompressOverBytes int
+
+	// RejectEmptyRecords makes writes fail with ErrEmptyRecord when a
+	// record encodes to nothing, null or {}, which usually means a caller
+	// passed the wrong value.
+	RejectEmptyRecords bool
+
+	// HierarchicalKeys lets resource keys hold "/" separated segments, such
+	// as "2024/invoices/0001", stored in nested directories under the
+	// collection. ReadAll and the other collection walks then descend into
+	// those directories, so a collection can't also have collections nested
+	// inside it.
+	HierarchicalKeys bool
+
+	// KeepBackup keeps the version of a record that each write or delete
+	// replaces in a ".bak" file next to it, which Rollback restores.
+	KeepBackup bool
+
+	// DetectCaseCollision makes writes fail with ErrCaseCollision when the
+	// record's directory already holds a file whose name differs from the
+	// record's only by case, which a case-insensitive filesystem would
+	// otherwise overwrite. Each write then lists that directory.
+	DetectCaseCollision bool
+
+	// BackupConcurrent makes Backup hold the database's locks only while
+	// it hard links every record into a snapshot directory, so writers
+	// aren't blocked while the archive is compressed. The database
+	// directory must be on a filesystem that supports hard links.
+	BackupConcurrent bool
+
+	// KeyPolicy, if set, replaces DefaultKeyPolicy as the rules resource
+	// keys must follow.
+	KeyPolicy *KeyPolicy
+
+	// MaxInputBytes and MaxInputDepth, if set, bound the records ImportZip
+	// and ApplyChanges accept from outside: a record larger than
+	// MaxInputBytes, or JSON nested more than MaxInputDepth arrays and
+	// objects deep, fails with ErrInputTooComplex.
+	MaxInputBytes int
+	MaxInputDepth int
+
+	// PermMask clears permission bits from every directory and file the
+	// Driver creates, on top of the process umask. Without it directories
+	// are created 0755 and files 0644.
+	PermMask os.FileMode
+
+	// ReadOnly opens the database in read-only mode; see SetReadOnly.
+	ReadOnly bool
+
+	// ChangeLog records every write and delete, with the written data, in
+	// a sequence numbered log that Changes, ExportChanges and ApplyChanges
+	// read from.
+	ChangeLog bool
+
+	// CacheSize, if set, keeps up to this many recently read or written
+	// records in memory so Read can skip the filesystem. The cache only
+	// sees changes made through this Driver.
+	CacheSize int
+
+	// OnEvict, if set, is called with the encoded bytes of every record
+	// that leaves the cache, whether pushed out by newer entries or deleted.
+	// It runs while the operation causing the eviction still holds its
+	// collection locks, which needn't be the evicted record's collection,
+	// so it must not call back into the Driver.
+	OnEvict func(collection, resource string, value []byte)
+
+	// OperationTimeout, if set, bounds how long the reads and writes of
+	// single collections, such as Write, WriteBatchResults, Pop, Read,
+	// ReadAll and Delete, wait on locks and the filesystem before giving up with
+	// context.DeadlineExceeded. A timed out operation may still complete
+	// in the background.
+	OperationTimeout time.Duration
+
+	// CoalesceEvents, if set, holds change events back for this long after
+	// the first one and delivers a single event, the latest, per resource.
+	CoalesceEvents time.Duration
+
+	// OnDecodeError decides what ReadAllTyped, Find and ForEach do with a
+	// record that can't be decoded. It defaults to FailOnDecodeError.
+	OnDecodeError DecodeErrorHandler
+
+	// MutexStripes, if set, replaces the lock the Driver keeps per
+	// collection with this many locks shared between collections by a hash
+	// of their name, so locking a collection doesn't go through the
+	// Driver's own mutex and the locks don't grow with the number of
+	// collections. Unrelated collections that hash to the same stripe then
+	// wait on each other, which gets rarer the more stripes there are.
+	MutexStripes int
+
+	// MaxOpenCollections, if set, bounds how many per-collection locks the
+	// Driver keeps, dropping the least recently used ones that nobody holds
+	// or is waiting for and recreating them on the next access. More can
+	// be kept while more than this many collections are in use at once.
+	// It has no effect with MutexStripes.
+	MaxOpenCollections int
+
+	// LockStats makes the Driver time how long it waits for each
+	// collection's lock, as reported by LockStats.
+	LockStats bool
+
+	// MaxConcurrentFiles, if set, caps how many record files the Driver's
+	// read operations keep open at once. Reads past the limit wait for a
+	// file to be closed.
+	MaxConcurrentFiles int
+
+	// MaxReadAllRecords, if set, makes ReadAll fail with ErrResultTooLarge
+	// rather than return more than this many records.
+	MaxReadAllRecords int
+
+	// Transform, if set, is called by Write and WriteBatch before a record
+	// is encoded. The value it returns is stored instead of the original;
+	// returning an error rejects the write.
+	Transform func(collection, resource string, v interface{}) (interface{}, error)
+
+	// PostRead, if set, is called with every record Read, ReadMulti,
+	// ReadFallback, ReadWithHash, DeleteAndReturn and the typed readers
+	// decode, given a pointer to the decoded value so it can normalize it
+	// in place. Returning an error rejects the record: the typed readers
+	// pass it to OnDecodeError, the others return it.
+	PostRead func(collection, resource string, v interface{}) error
 }
 
 func New(dir string, options *Options) (*Driver, error) {
@@ -51,15 +293,171 @@ func New(dir string, options *Options) (*Driver, error) {
 		dir:     dir,
 		mutexes: make(map[string]*sync.Mutex),
 		log:     opts.Logger,
+		durable: opts.Durable,
+		codec:   opts.Codec,
+		storage: osStorage{},
+		stale:   opts.StaleAfter,
+		timeout: opts.OperationTimeout,
+		maxOpen: opts.MaxOpenCollections,
+
+		openOrder: list.New(),
+		openItems: make(map[string]*list.Element),
+		pins:      make(map[string]int),
+
+		compressOver: opts.CompressOverBytes,
+		canonical:    opts.CanonicalJSON,
+		rejectEmpty:  opts.RejectEmptyRecords,
+		hierarchical: opts.HierarchicalKeys,
+		keepBackup:   opts.KeepBackup,
+		detectCase:   opts.DetectCaseCollision,
+		backupConc:   opts.BackupConcurrent,
+		maxReadAll:   opts.MaxReadAllRecords,
+		keyPolicy:    DefaultKeyPolicy,
+		maxInput:     opts.MaxInputBytes,
+		permMask:     opts.PermMask,
+		maxDepth:     opts.MaxInputDepth,
+		lockStats:    opts.LockStats,
+		stats:        make(map[string]LockStat),
+		cache:        newCache(opts.CacheSize, opts.OnEvict),
+		fieldMaps:    make(map[string]map[string]string),
+		compressions: make(map[string]int),
+
+		onDecodeError: opts.OnDecodeError,
+		transform:     opts.Transform,
+		postRead:      opts.PostRead,
+		indexes:       make(map[string]map[string]*index),
+		types:         make(map[string]map[string]registeredType),
+		defaults:      make(map[reflect.Type]interface{}),
+		watchers:      make(map[*watcher]struct{}),
+		coalesce:      opts.CoalesceEvents,
+		changeLog:     opts.ChangeLog,
+
+		recordDefaults: make(map[string]map[string]interface{}),
+		schemas:        make(map[string]Schema),
+		references:     make(map[string][]reference),
+	}
+
+	driver.SetReadOnly(opts.ReadOnly)
+
+	if opts.KeyPolicy != nil {
+		driver.keyPolicy = *opts.KeyPolicy
+	}
+
+	if opts.MutexStripes > 0 {
+		driver.stripes = make([]sync.Mutex, opts.MutexStripes)
+	}
+
+	if opts.MaxConcurrentFiles > 0 {
+		driver.files = make(chan struct{}, opts.MaxConcurrentFiles)
+	}
+
+	if driver.codec == nil {
+		driver.codec = JSONCodec{}
+	}
+
+	if driver.onDecodeError == nil {
+		driver.onDecodeError = FailOnDecodeError
 	}
 
-	if _, err := os.Stat(dir); err != nil {
+	if _, err := os.Stat(dir); err == nil {
 		opts.Logger.Debug("Using '%s' (Database already exists)", dir)
-		return &driver, nil
+	} else {
+		opts.Logger.Debug("Creating the database at '%s'...\n", dir)
+		if err := os.MkdirAll(dir, driver.dirMode()); err != nil {
+			return &driver, err
+		}
+	}
+
+	if err := driver.loadConfigs(); err != nil {
+		return &driver, err
+	}
+
+	if driver.changeLog {
+		return &driver, driver.openChangeLog()
+	}
+
+	return &driver, nil
+}
+
+// Dir returns the cleaned path of the directory the database lives in.
+func (d *Driver) Dir() string {
+	d.dirMutex.RLock()
+	defer d.dirMutex.RUnlock()
+
+	return d.dir
+}
+
+// SetReadOnly switches read-only mode on or off. While it is on, every
+// operation that would change the database fails with ErrReadOnly and
+// reads keep working.
+func (d *Driver) SetReadOnly(readOnly bool) {
+	var v int32
+	if readOnly {
+		v = 1
+	}
+	atomic.StoreInt32(&d.readOnly, v)
+}
+
+// dirMode and fileMode are the permissions the Driver creates directories
+// and files with.
+func (d *Driver) dirMode() os.FileMode {
+	return 0755 &^ d.permMask
+}
+
+func (d *Driver) fileMode() os.FileMode {
+	return 0644 &^ d.permMask
+}
+
+func (d *Driver) checkWritable() error {
+	if atomic.LoadInt32(&d.readOnly) != 0 {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// Relocate moves the whole database to newDir, which must not exist yet,
+// and keeps using it from there. Every collection is locked for the
+// duration of the move. When newDir is on another filesystem the tree is
+// copied and the original removed.
+func (d *Driver) Relocate(newDir string) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+
+	newDir = filepath.Clean(newDir)
+
+	unlock := d.lockAll()
+	defer unlock()
+
+	if _, err := os.Stat(newDir); err == nil {
+		return fmt.Errorf("unable to relocate to %s - it already exists", newDir)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(newDir), d.dirMode()); err != nil {
+		return err
 	}
 
-	opts.Logger.Debug("Creating the database at '%s'...\n", dir)
-	return &driver, os.Mkdir(dir, 0755)
+	oldDir := d.Dir()
+	if err := os.Rename(oldDir, newDir); err != nil {
+		if !errors.Is(err, syscall.EXDEV) {
+			return err
+		}
+
+		if err := copyTree(oldDir, newDir); err != nil {
+			os.RemoveAll(newDir)
+			return err
+		}
+
+		if err := os.RemoveAll(oldDir); err != nil {
+			d.log.Warn("Relocated '%s' to '%s' but could not remove the original: %s", oldDir, newDir, err)
+		}
+	}
+
+	d.dirMutex.Lock()
+	d.dir = newDir
+	d.dirMutex.Unlock()
+
+	return nil
 }
 
 func (d *Driver) Write(collection, resource string, v interface{}) error {
@@ -69,118 +467,2602 @@ func (d *Driver) Write(collection, resource string, v interface{}) error {
 	if resource == "" {
 		return fmt.Errorf("missing rsource - unable to save")
 	}
+	if err := d.checkResource(resource); err != nil {
+		return err
+	}
+
+	b, err := d.prepare(collection, resource, v)
+	if err != nil {
+		return err
+	}
+
+	return d.withTimeout(func() error {
+		mutex := d.lockCollection(collection)
+		defer mutex.Unlock()
+
+		return d.writeRecord(collection, resource, b)
+	})
+}
+
+// TryWrite is Write for callers that would rather skip the write than wait
+// for the collection's lock: if another operation holds it, TryWrite
+// returns false without writing.
+func (d *Driver) TryWrite(collection, resource string, v interface{}) (bool, error) {
+	if collection == "" {
+		return false, fmt.Errorf("missing collection - no place to save record")
+	}
+	if resource == "" {
+		return false, fmt.Errorf("missing resource - unable to save")
+	}
+	if err := d.checkResource(resource); err != nil {
+		return false, err
+	}
+
+	b, err := d.prepare(collection, resource, v)
+	if err != nil {
+		return false, err
+	}
 
 	mutex := d.getOrCreateMutex(collection)
-	mutex.Lock()
+	locked := mutex.TryLock()
+	d.unpin(collection)
+	if !locked {
+		return false, nil
+	}
 	defer mutex.Unlock()
 
-	dir := filepath.Join(d.dir, collection)
-	fnlpath := filepath.Join(dir, resource) + ".json"
-	tempPath := fnlpath + ".tmp"
+	return true, d.writeRecord(collection, resource, b)
+}
 
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return err
+// WriteIfChanged is Write that leaves the record alone, returning false,
+// when it already holds exactly the bytes v encodes to. The comparison and
+// the write happen under the collection's lock.
+func (d *Driver) WriteIfChanged(collection, resource string, v interface{}) (changed bool, err error) {
+	if collection == "" {
+		return false, fmt.Errorf("missing collection - no place to save record")
+	}
+	if resource == "" {
+		return false, fmt.Errorf("missing resource - unable to save")
+	}
+	if err := d.checkResource(resource); err != nil {
+		return false, err
 	}
 
-	b, err := json.MarshalIndent(v, "", "\t")
+	b, err := d.prepare(collection, resource, v)
 	if err != nil {
+		return false, err
+	}
+
+	return timed(d, func() (bool, error) {
+		mutex := d.lockCollection(collection)
+		defer mutex.Unlock()
+
+		existing, err := d.readRecordLocked(collection, resource)
+		if err == nil && bytes.Equal(existing, b) {
+			return false, nil
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+
+		return true, d.writeRecord(collection, resource, b)
+	})
+}
+
+// writeRecord atomically stores encoded record bytes. The caller must hold
+// the collection's mutex.
+func (d *Driver) writeRecord(collection, resource string, b []byte) error {
+	if err := d.checkWritable(); err != nil {
 		return err
 	}
 
-	b = append(b, byte('\n'))
+	dir := filepath.Dir(d.recordPath(collection, resource))
 
-	if err := ioutil.WriteFile(tempPath, b, 0644); err != nil {
+	if err := os.MkdirAll(dir, d.dirMode()); err != nil {
 		return err
 	}
 
-	return os.Rename(tempPath, fnlpath)
+	if err := d.putRecord(collection, resource, b); err != nil {
+		return err
+	}
+
+	if d.durable {
+		return syncDir(dir)
+	}
+
+	return nil
 }
 
-func (d *Driver) Read(collection, resource string, v interface{}) error {
-	if collection == "" {
-		return fmt.Errorf("missing collection - no place to read record")
+// putRecord checks the collection's constraints and stores the record
+// without syncing its directory. The caller must hold the collection's
+// mutex and have created the record's directory.
+func (d *Driver) putRecord(collection, resource string, b []byte) error {
+	if err := d.checkWritable(); err != nil {
+		return err
 	}
-	if resource == "" {
-		return fmt.Errorf("missing resource - unable to read")
+
+	doc, err := d.checkIndexes(collection, resource, b)
+	if err != nil {
+		return err
 	}
 
-	record := filepath.Join(d.dir, collection, resource)
+	path := d.recordPath(collection, resource)
+	if d.detectCase {
+		if err := checkCaseCollision(path); err != nil {
+			return err
+		}
+	}
+	if d.keepBackup {
+		if err := backupRecord(path); err != nil {
+			return err
+		}
+	}
 
-	if _, err := stat(record); err != nil {
+	if err := d.storeRecord(collection, path, b); err != nil {
 		return err
 	}
 
-	b, err := ioutil.ReadFile(record + ".json")
+	d.updateIndexes(collection, resource, doc)
+	d.cache.put(collection, resource, b, time.Now())
+	d.notify(OpWrite, collection, resource)
+	d.metrics.wrote(b)
+	d.bumpVersion(collection)
+
+	return d.logChange(OpWrite, collection, resource, b)
+}
+
+// checkCaseCollision fails with ErrCaseCollision if the directory of the
+// record at path holds another record file, compressed or not, whose name
+// matches path's ignoring case.
+func checkCaseCollision(path string) error {
+	files, err := ioutil.ReadDir(filepath.Dir(path))
 	if err != nil {
 		return err
 	}
 
-	return json.Unmarshal(b, &v)
+	name := filepath.Base(path)
+	for _, file := range files {
+		existing := strings.TrimSuffix(file.Name(), compressedExt)
+		if existing != name && strings.EqualFold(existing, name) {
+			return fmt.Errorf("%w: %s is already stored as %s", ErrCaseCollision, name, existing)
+		}
+	}
+
+	return nil
 }
 
-func (d *Driver) ReadAll(collection string) ([]string, error) {
+// WriteBatch writes every record into the collection under a single lock.
+// Records are written one by one, so a failure part way through leaves the
+// earlier records in place. With Durable set the collection directory is
+// fsynced once after the whole batch instead of after every record.
+func (d *Driver) WriteBatch(collection string, records map[string]interface{}) error {
 	if collection == "" {
-		return nil, fmt.Errorf("missing collection - no place to read record")
+		return fmt.Errorf("missing collection - no place to save records")
 	}
 
-	dir := filepath.Join(d.dir, collection)
+	encoded := make(map[string][]byte, len(records))
+	for resource, v := range records {
+		if resource == "" {
+			return fmt.Errorf("missing resource - unable to save")
+		}
+		if err := d.checkResource(resource); err != nil {
+			return err
+		}
 
-	if _, err := stat(dir); err != nil {
-		return nil, err
+		b, err := d.prepare(collection, resource, v)
+		if err != nil {
+			return err
+		}
+		encoded[resource] = b
 	}
 
-	files, _ := ioutil.ReadDir(dir)
+	return d.withTimeout(func() error {
+		mutex := d.lockCollection(collection)
+		defer mutex.Unlock()
 
-	var records []string
-	for _, file := range files {
-		b, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err := d.checkWritable(); err != nil {
+			return err
+		}
+
+		dir := filepath.Join(d.Dir(), collection)
+		if err := os.MkdirAll(dir, d.dirMode()); err != nil {
+			return err
+		}
+
+		for resource, b := range encoded {
+			if d.hierarchical {
+				if err := os.MkdirAll(filepath.Dir(d.recordPath(collection, resource)), d.dirMode()); err != nil {
+					return err
+				}
+			}
+
+			if err := d.putRecord(collection, resource, b); err != nil {
+				return err
+			}
+		}
+
+		if d.durable {
+			return syncDir(dir)
+		}
+
+		return nil
+	})
+}
+
+// WriteBatchResults is like WriteBatch but attempts every record on its
+// own, in resource order, and reports how each went: the map holds an
+// entry for every resource, nil for the records that were written.
+func (d *Driver) WriteBatchResults(collection string, records map[string]interface{}) map[string]error {
+	results := make(map[string]error, len(records))
+	resources := make([]string, 0, len(records))
+	encoded := make(map[string][]byte, len(records))
+
+	for resource, v := range records {
+		switch {
+		case collection == "":
+			results[resource] = fmt.Errorf("missing collection - no place to save records")
+		case resource == "":
+			results[resource] = fmt.Errorf("missing resource - unable to save")
+		default:
+			results[resource] = d.checkResource(resource)
+		}
+		if results[resource] != nil {
+			continue
+		}
+
+		b, err := d.prepare(collection, resource, v)
 		if err != nil {
-			return nil, err
+			results[resource] = err
+			continue
 		}
+		encoded[resource] = b
+		resources = append(resources, resource)
+	}
+	sort.Strings(resources)
 
-		records = append(records, string(b))
+	written, err := timed(d, func() (map[string]error, error) {
+		mutex := d.lockCollection(collection)
+		defer mutex.Unlock()
+
+		written := make(map[string]error, len(resources))
+		for _, resource := range resources {
+			written[resource] = d.writeRecord(collection, resource, encoded[resource])
+		}
+		return written, nil
+	})
+
+	for _, resource := range resources {
+		if err != nil {
+			results[resource] = err
+		} else {
+			results[resource] = written[resource]
+		}
 	}
 
-	return records, nil
+	return results
 }
 
-func (d *Driver) Delete(collection, resource string) error {
-	path := filepath.Join(collection, resource)
-	mutex := d.getOrCreateMutex(collection)
+// MapCollection passes every record of the collection through fn under the
+// collection's lock and writes back the ones fn changes, returning how many
+// it rewrote. fn sees the record as stored, after decompression; returning
+// the same bytes leaves the record alone. An error from fn stops the walk,
+// leaving the records rewritten so far in place.
+func (d *Driver) MapCollection(collection string, fn func(resource string, raw []byte) ([]byte, error)) (updated int, err error) {
+	if collection == "" {
+		return 0, fmt.Errorf("missing collection - no place to save records")
+	}
 
-	mutex.Lock()
-	defer mutex.Unlock()
+	err = d.withTimeout(func() error {
+		mutex := d.lockCollection(collection)
+		defer mutex.Unlock()
+
+		if err := d.checkWritable(); err != nil {
+			return err
+		}
 
-	dir := filepath.Join(d.dir, path)
+		var resources []string
+		if err := d.eachRecordFile(collection, func(resource, path string, fi os.FileInfo) error {
+			resources = append(resources, resource)
+			return nil
+		}); err != nil {
+			return err
+		}
 
-	switch fi, err := stat(dir); {
-	case fi == nil && err != nil:
-		return fmt.Errorf("unable to find file or directory named %s", path)
-	case fi.Mode().IsDir():
-		return os.RemoveAll(dir)
-	case fi.Mode().IsRegular():
-		return os.RemoveAll(dir + ".json")
-	}
+		for _, resource := range resources {
+			b, err := d.readRecordLocked(collection, resource)
+			if err != nil {
+				return err
+			}
 
-	return nil
+			out, err := fn(resource, b)
+			if err != nil {
+				return fmt.Errorf("%s/%s: %w", collection, resource, err)
+			}
+			if bytes.Equal(out, b) {
+				continue
+			}
+			if err := d.checkInput(resource, out); err != nil {
+				return err
+			}
+
+			if err := d.putRecord(collection, resource, out); err != nil {
+				return err
+			}
+			updated++
+		}
+
+		if d.durable && updated > 0 {
+			return syncDir(filepath.Join(d.Dir(), collection))
+		}
+
+		return nil
+	})
+
+	return updated, err
 }
 
-func (d *Driver) getOrCreateMutex(collection string) *sync.Mutex {
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
+// ReplaceCollection swaps the whole contents of the collection for records.
+// The new records are written to a staging directory next to the
+// collection, which is then renamed into place, so ReadAll sees either the
+// old set or the new one and a failure before the swap leaves the
+// collection untouched.
+func (d *Driver) ReplaceCollection(collection string, records map[string]interface{}) error {
+	if collection == "" {
+		return fmt.Errorf("missing collection - no place to save records")
+	}
 
-	m, ok := d.mutexes[collection]
-	if !ok {
-		m = &sync.Mutex{}
-		d.mutexes[collection] = m
+	resources := make([]string, 0, len(records))
+	encoded := make(map[string][]byte, len(records))
+	for resource, v := range records {
+		if resource == "" {
+			return fmt.Errorf("missing resource - unable to save")
+		}
+		if err := d.checkResource(resource); err != nil {
+			return err
+		}
+
+		b, err := d.prepare(collection, resource, v)
+		if err != nil {
+			return err
+		}
+		encoded[resource] = b
+		resources = append(resources, resource)
 	}
+	sort.Strings(resources)
 
-	return m
+	return d.withTimeout(func() error {
+		mutex := d.lockCollection(collection)
+		defer mutex.Unlock()
+
+		return d.replaceCollection(collection, resources, encoded, nil)
+	})
 }
 
-func stat(path string) (fi os.FileInfo, err error) {
-	if fi, err = os.Stat(path); os.IsNotExist(err) {
-		fi, err = os.Stat(path + ".json")
+// replaceCollection does the work of ReplaceCollection, also replacing the
+// collection's saved config if config is given. The caller must hold the
+// collection's mutex.
+func (d *Driver) replaceCollection(collection string, resources []string, encoded map[string][]byte, config []byte) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+
+	indexes, err := d.reindex(collection, encoded)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(d.Dir(), collection)
+	staging, old := dir+replacingSuffix, dir+replacedSuffix
+
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(staging, d.dirMode()); err != nil {
+		return err
+	}
+	if err := d.copyCollectionFiles(dir, staging, config); err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+
+	for _, resource := range resources {
+		path := filepath.Join(staging, strings.TrimSuffix(resource, d.codec.Ext())) + d.codec.Ext()
+		if err := os.MkdirAll(filepath.Dir(path), d.dirMode()); err != nil {
+			os.RemoveAll(staging)
+			return err
+		}
+		if err := d.storeRecord(collection, path, encoded[resource]); err != nil {
+			os.RemoveAll(staging)
+			return err
+		}
+	}
+
+	if d.durable {
+		if err := syncDir(staging); err != nil {
+			os.RemoveAll(staging)
+			return err
+		}
+	}
+
+	if err := os.RemoveAll(old); err != nil {
+		return err
+	}
+	if err := os.Rename(dir, old); err != nil && !os.IsNotExist(err) {
+		os.RemoveAll(staging)
+		return err
+	}
+	if err := os.Rename(staging, dir); err != nil {
+		os.Rename(old, dir)
+		return err
+	}
+	if err := os.RemoveAll(old); err != nil {
+		d.log.Warn("Replaced collection %s but could not remove the old records: %s", collection, err)
+	}
+
+	if d.durable {
+		if err := syncDir(filepath.Dir(dir)); err != nil {
+			return err
+		}
+	}
+
+	d.mutex.Lock()
+	if len(indexes) > 0 {
+		d.indexes[collection] = indexes
+	}
+	d.mutex.Unlock()
+
+	d.cache.removeCollection(collection)
+	d.notify(OpDelete, collection, "")
+	d.bumpVersion(collection)
+	if err := d.logChange(OpDelete, collection, "", nil); err != nil {
+		return err
+	}
+
+	for _, resource := range resources {
+		b := encoded[resource]
+		d.cache.put(collection, resource, b, time.Now())
+		d.metrics.wrote(b)
+		d.notify(OpWrite, collection, resource)
+		if err := d.logChange(OpWrite, collection, resource, b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *Driver) Read(collection, resource string, v interface{}) error {
+	if collection == "" {
+		return fmt.Errorf("missing collection - no place to read record")
+	}
+	if resource == "" {
+		return fmt.Errorf("missing resource - unable to read")
+	}
+	if err := d.checkResource(resource); err != nil {
+		return err
+	}
+
+	b, err := timed(d, func() ([]byte, error) {
+		return d.readRecord(collection, resource)
+	})
+	if err != nil {
+		return err
+	}
+
+	return d.decodeRead(collection, resource, b, v)
+}
+
+// TryRead is Read for callers that expect records to be missing: it
+// returns false and no error when the record doesn't exist, keeping err
+// for real failures. found is true when the record exists, even if it
+// then can't be decoded.
+func (d *Driver) TryRead(collection, resource string, v interface{}) (found bool, err error) {
+	if collection == "" {
+		return false, fmt.Errorf("missing collection - no place to read record")
+	}
+	if resource == "" {
+		return false, fmt.Errorf("missing resource - unable to read")
+	}
+	if err := d.checkResource(resource); err != nil {
+		return false, err
+	}
+
+	b, err := timed(d, func() ([]byte, error) {
+		return d.readRecord(collection, resource)
+	})
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, d.decodeRead(collection, resource, b, v)
+}
+
+// ReadMulti reads a record once and decodes it into each of targets in
+// turn, stopping at the first that fails.
+func (d *Driver) ReadMulti(collection, resource string, targets ...interface{}) error {
+	if collection == "" {
+		return fmt.Errorf("missing collection - no place to read record")
+	}
+	if resource == "" {
+		return fmt.Errorf("missing resource - unable to read")
+	}
+	if err := d.checkResource(resource); err != nil {
+		return err
+	}
+
+	b, err := timed(d, func() ([]byte, error) {
+		return d.readRecord(collection, resource)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, v := range targets {
+		if err := d.decodeRead(collection, resource, b, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReadFallback reads resource from the first of collections holding it,
+// which lets a specific collection override a more general one listed
+// after it. It returns ErrRecordNotFound if none of them hold it.
+func (d *Driver) ReadFallback(resource string, collections []string, v interface{}) error {
+	if resource == "" {
+		return fmt.Errorf("missing resource - unable to read")
+	}
+	if err := d.checkResource(resource); err != nil {
+		return err
+	}
+
+	for _, collection := range collections {
+		if collection == "" {
+			return fmt.Errorf("missing collection - no place to read record")
+		}
+	}
+
+	// The read may outlive this call, so it works on its own copy.
+	collections = append([]string(nil), collections...)
+
+	type found struct {
+		collection string
+		b          []byte
+	}
+	r, err := timed(d, func() (found, error) {
+		for _, collection := range collections {
+			b, err := d.readRecord(collection, resource)
+			if os.IsNotExist(err) {
+				continue
+			}
+			return found{collection, b}, err
+		}
+		return found{}, fmt.Errorf("%w: %s in %s", ErrRecordNotFound, resource, strings.Join(collections, ", "))
+	})
+	if err != nil {
+		return err
+	}
+
+	return d.decodeRead(r.collection, resource, r.b, v)
+}
+
+// ReadWithHash decodes a record into v like Read and also returns the
+// SHA-256 of the encoded bytes it decoded, as reported by RecordHash.
+func (d *Driver) ReadWithHash(collection, resource string, v interface{}) (hash string, err error) {
+	if collection == "" {
+		return "", fmt.Errorf("missing collection - no place to read record")
+	}
+	if resource == "" {
+		return "", fmt.Errorf("missing resource - unable to read")
+	}
+	if err := d.checkResource(resource); err != nil {
+		return "", err
+	}
+
+	b, err := timed(d, func() ([]byte, error) {
+		return d.readRecord(collection, resource)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if err := d.decodeRead(collection, resource, b, v); err != nil {
+		return "", err
+	}
+
+	return hashBytes(b), nil
+}
+
+// RecordHash returns the hex encoded SHA-256 of a record's encoded bytes,
+// taken before any compression.
+func (d *Driver) RecordHash(collection, resource string) (string, error) {
+	if collection == "" {
+		return "", fmt.Errorf("missing collection - no place to read record")
+	}
+	if resource == "" {
+		return "", fmt.Errorf("missing resource - unable to read")
+	}
+	if err := d.checkResource(resource); err != nil {
+		return "", err
+	}
+
+	b, err := timed(d, func() ([]byte, error) {
+		return d.readRecord(collection, resource)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return hashBytes(b), nil
+}
+
+// readRecord returns the stored bytes of a record. On a cache miss the file
+// is read under the collection's mutex, so the bytes put in the cache can't
+// be older than those of a write or delete that finished in the meantime.
+func (d *Driver) readRecord(collection, resource string) ([]byte, error) {
+	resource = strings.TrimSuffix(resource, d.codec.Ext())
+	atomic.AddUint64(&d.metrics.reads, 1)
+
+	if entry, ok := d.cache.get(collection, resource); ok {
+		d.warnIfStale(collection, resource, entry.modTime)
+		return entry.value, nil
+	}
+
+	if d.cache != nil {
+		mutex := d.lockCollection(collection)
+		defer mutex.Unlock()
+	}
+
+	return d.readRecordLocked(collection, resource)
+}
+
+// readRecordLocked is readRecord for callers that already hold the
+// collection's mutex.
+func (d *Driver) readRecordLocked(collection, resource string) ([]byte, error) {
+	resource = strings.TrimSuffix(resource, d.codec.Ext())
+
+	if entry, ok := d.cache.get(collection, resource); ok {
+		d.warnIfStale(collection, resource, entry.modTime)
+		return entry.value, nil
+	}
+
+	path, fi, err := d.recordFile(collection, resource)
+	if err != nil {
+		return nil, err
+	}
+	d.warnIfStale(collection, resource, fi.ModTime())
+
+	b, err := d.readRecordFile(path)
+	if err != nil {
+		return nil, err
+	}
+	d.cache.put(collection, resource, b, fi.ModTime())
+
+	return b, nil
+}
+
+func (d *Driver) warnIfStale(collection, resource string, modTime time.Time) {
+	if age := time.Since(modTime); d.stale > 0 && age > d.stale {
+		d.log.Warn("Reading stale record %s/%s (last written %s ago)", collection, resource, age.Round(time.Second))
+	}
+}
+
+// ReadAll returns the contents of every file in the collection. It holds
+// the collection's lock while reading, so it never sees a collection part
+// way through ReplaceCollection.
+func (d *Driver) ReadAll(collection string) ([]string, error) {
+	if collection == "" {
+		return nil, fmt.Errorf("missing collection - no place to read record")
+	}
+
+	return timed(d, func() ([]string, error) {
+		mutex := d.lockCollection(collection)
+		defer mutex.Unlock()
+
+		return d.readAll(collection)
+	})
+}
+
+func (d *Driver) readAll(collection string) ([]string, error) {
+	dir := filepath.Join(d.Dir(), collection)
+
+	if _, err := d.stat(dir); err != nil {
+		return nil, err
+	}
+
+	return d.readAllIn(collection, dir, nil)
+}
+
+// readAllIn appends the contents of every file in dir to records,
+// descending into subdirectories when HierarchicalKeys is set.
+func (d *Driver) readAllIn(collection, dir string, records []string) ([]string, error) {
+	files, _ := ioutil.ReadDir(dir)
+
+	for _, file := range files {
+		path := filepath.Join(dir, file.Name())
+
+		if file.IsDir() && d.hierarchical {
+			var err error
+			if records, err = d.readAllIn(collection, path, records); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if !d.isRecordFile(file) {
+			continue
+		}
+
+		if d.maxReadAll > 0 && len(records) == d.maxReadAll {
+			return nil, fmt.Errorf("collection %s has more than %d records: %w", collection, d.maxReadAll, ErrResultTooLarge)
+		}
+
+		b, err := d.readRecordFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if b, err = d.plain(collection, b); err != nil {
+			return nil, err
+		}
+
+		records = append(records, string(b))
+	}
+
+	return records, nil
+}
+
+// ReadPageWithTotal returns up to limit records of the collection, in name
+// order, starting offset records in, along with how many records the
+// collection holds in all. Both come from one pass under the collection's
+// lock, and only the records on the page are read.
+func (d *Driver) ReadPageWithTotal(collection string, offset, limit int) (records []string, total int, err error) {
+	if collection == "" {
+		return nil, 0, fmt.Errorf("missing collection - no place to read record")
+	}
+	if offset < 0 || limit < 0 {
+		return nil, 0, fmt.Errorf("invalid page - offset %d and limit %d can't be negative", offset, limit)
+	}
+
+	type page struct {
+		records []string
+		total   int
+	}
+	p, err := timed(d, func() (page, error) {
+		mutex := d.lockCollection(collection)
+		defer mutex.Unlock()
+
+		var p page
+		err := d.eachRecordFile(collection, func(resource, path string, fi os.FileInfo) error {
+			p.total++
+			if p.total <= offset || len(p.records) == limit {
+				return nil
+			}
+
+			b, err := d.readRecordFile(path)
+			if err != nil {
+				return err
+			}
+			if b, err = d.plain(collection, b); err != nil {
+				return err
+			}
+
+			p.records = append(p.records, string(b))
+			return nil
+		})
+		return p, err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return p.records, p.total, nil
+}
+
+// ReadAllRaw returns every record in the collection, in name order, as
+// JSON that has been checked to be valid but not decoded. Temp and internal
+// files are skipped. Like ReadAll it reads under the collection's lock.
+func (d *Driver) ReadAllRaw(collection string) ([]json.RawMessage, error) {
+	if collection == "" {
+		return nil, fmt.Errorf("missing collection - no place to read record")
+	}
+
+	return timed(d, func() ([]json.RawMessage, error) {
+		mutex := d.lockCollection(collection)
+		defer mutex.Unlock()
+
+		var records []json.RawMessage
+		err := d.eachRecord(collection, func(resource string, b []byte) error {
+			b, err := d.plain(collection, b)
+			if err != nil {
+				return err
+			}
+
+			if !json.Valid(b) {
+				return fmt.Errorf("record %s/%s is not valid JSON", collection, resource)
+			}
+
+			records = append(records, json.RawMessage(b))
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return records, nil
+	})
+}
+
+// CollectionResource names one record for ReadPairs.
+type CollectionResource struct {
+	Collection string
+	Resource   string
+}
+
+// AllKeys walks every collection in name order on a single goroutine and
+// sends the key of each record on the returned channel, without reading
+// the records. The channels close as ReadAllChan's do, and the keys must
+// likewise be received until the first channel is closed.
+func (d *Driver) AllKeys() (<-chan CollectionResource, <-chan error) {
+	keys := make(chan CollectionResource)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(errs)
+		defer close(keys)
+
+		collections, err := d.collections()
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		for _, collection := range collections {
+			err := d.eachRecordFile(collection, func(resource, path string, fi os.FileInfo) error {
+				keys <- CollectionResource{Collection: collection, Resource: resource}
+				return nil
+			})
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	return keys, errs
+}
+
+// ReadPairs reads the records named by pairs, locking each collection once
+// for all of its records, and returns them as JSON keyed by pair. Records
+// that don't exist are left out of the map.
+func (d *Driver) ReadPairs(pairs []CollectionResource) (map[CollectionResource]json.RawMessage, error) {
+	byCollection := make(map[string][]string)
+	var collections []string
+	for _, pair := range pairs {
+		if pair.Collection == "" {
+			return nil, fmt.Errorf("missing collection - no place to read record")
+		}
+		if pair.Resource == "" {
+			return nil, fmt.Errorf("missing resource - unable to read")
+		}
+		if err := d.checkResource(pair.Resource); err != nil {
+			return nil, err
+		}
+
+		if _, ok := byCollection[pair.Collection]; !ok {
+			collections = append(collections, pair.Collection)
+		}
+		byCollection[pair.Collection] = append(byCollection[pair.Collection], pair.Resource)
+	}
+
+	return timed(d, func() (map[CollectionResource]json.RawMessage, error) {
+		records := make(map[CollectionResource]json.RawMessage, len(pairs))
+		for _, collection := range collections {
+			if err := d.readPairsIn(collection, byCollection[collection], records); err != nil {
+				return nil, err
+			}
+		}
+		return records, nil
+	})
+}
+
+func (d *Driver) readPairsIn(collection string, resources []string, records map[CollectionResource]json.RawMessage) error {
+	mutex := d.lockCollection(collection)
+	defer mutex.Unlock()
+
+	for _, resource := range resources {
+		b, err := d.readRecordLocked(collection, resource)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if b, err = d.plain(collection, b); err != nil {
+			return err
+		}
+		if !json.Valid(b) {
+			return fmt.Errorf("record %s/%s is not valid JSON", collection, resource)
+		}
+
+		records[CollectionResource{collection, resource}] = json.RawMessage(b)
+	}
+
+	return nil
+}
+
+// ReadAllPartial is like ReadAll but stops reading once ctx is done. It then
+// returns the records read so far with complete set to false instead of an
+// error, so a slow collection still yields partial results.
+func (d *Driver) ReadAllPartial(ctx context.Context, collection string) (records []string, complete bool, err error) {
+	err = d.eachRecord(collection, func(resource string, b []byte) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		b, err := d.plain(collection, b)
+		if err != nil {
+			return err
+		}
+
+		records = append(records, string(b))
+		return nil
+	})
+
+	switch {
+	case err == nil:
+		return records, true, nil
+	case ctx.Err() != nil && errors.Is(err, ctx.Err()):
+		return records, false, nil
+	}
+
+	return nil, false, err
+}
+
+// eachRecord calls fn with the name and contents of every record in the
+// collection, in name order, skipping temp and internal files.
+func (d *Driver) eachRecord(collection string, fn func(resource string, b []byte) error) error {
+	return d.eachRecordFile(collection, func(resource, path string, fi os.FileInfo) error {
+		b, err := d.readRecordFile(path)
+		if err != nil {
+			return err
+		}
+
+		return fn(resource, b)
+	})
+}
+
+// eachRecordFile is like eachRecord but hands fn the record's path and file
+// info instead of reading it.
+func (d *Driver) eachRecordFile(collection string, fn func(resource, path string, fi os.FileInfo) error) error {
+	if collection == "" {
+		return fmt.Errorf("missing collection - no place to read record")
+	}
+
+	return d.eachRecordFileIn(filepath.Join(d.Dir(), collection), "", fn)
+}
+
+// eachRecordFileIn calls fn for the record files in dir, naming each with
+// prefix in front. With HierarchicalKeys set subdirectories are walked as
+// key prefixes.
+func (d *Driver) eachRecordFileIn(dir, prefix string, fn func(resource, path string, fi os.FileInfo) error) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		path := filepath.Join(dir, file.Name())
+
+		if file.IsDir() && d.hierarchical {
+			if err := d.eachRecordFileIn(path, prefix+file.Name()+"/", fn); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !d.isRecordFile(file) {
+			continue
+		}
+
+		resource := prefix + strings.TrimSuffix(strings.TrimSuffix(file.Name(), compressedExt), d.codec.Ext())
+		if err := fn(resource, path, file); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// KeysByModTime returns the collection's resource keys ordered by when the
+// records were last written, oldest first unless descending is set. Records
+// written at the same time are ordered by key.
+func (d *Driver) KeysByModTime(collection string, descending bool) ([]string, error) {
+	type entry struct {
+		resource string
+		modTime  time.Time
+	}
+
+	var entries []entry
+	err := d.eachRecordFile(collection, func(resource, path string, fi os.FileInfo) error {
+		entries = append(entries, entry{resource, fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if !a.modTime.Equal(b.modTime) {
+			return a.modTime.Before(b.modTime) != descending
+		}
+		return a.resource < b.resource
+	})
+
+	keys := make([]string, len(entries))
+	for i, e := range entries {
+		keys[i] = e.resource
+	}
+
+	return keys, nil
+}
+
+// Grep returns, in name order, the keys of the collection's records whose
+// stored bytes, with field names restored, contain substring. ignoreCase
+// makes the match case-insensitive.
+func (d *Driver) Grep(collection, substring string, ignoreCase bool) ([]string, error) {
+	needle := []byte(substring)
+	if ignoreCase {
+		needle = bytes.ToLower(needle)
+	}
+
+	var keys []string
+	err := d.eachRecord(collection, func(resource string, b []byte) error {
+		b, err := d.plain(collection, b)
+		if err != nil {
+			return err
+		}
+		if ignoreCase {
+			b = bytes.ToLower(b)
+		}
+
+		if bytes.Contains(b, needle) {
+			keys = append(keys, resource)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// Rotate moves the collection's records aside into a new collection named
+// after it and the current UTC time, such as users-20240102T150405.000000000Z,
+// and leaves the collection empty, keeping its config and sequence. It
+// returns the archive's name. The rename is a single atomic step taken
+// under the collection's lock. Watchers and the change log see the
+// collection deleted; the archive's records aren't reported as written.
+func (d *Driver) Rotate(collection string) (archive string, err error) {
+	if collection == "" {
+		return "", fmt.Errorf("missing collection - nothing to rotate")
+	}
+	if err := d.checkWritable(); err != nil {
+		return "", err
+	}
+
+	return timed(d, func() (string, error) {
+		mutex := d.lockCollection(collection)
+		defer mutex.Unlock()
+
+		if err := d.checkWritable(); err != nil {
+			return "", err
+		}
+
+		archive := collection + "-" + time.Now().UTC().Format("20060102T150405.000000000Z")
+		dir, archiveDir := filepath.Join(d.Dir(), collection), filepath.Join(d.Dir(), archive)
+
+		if _, err := os.Stat(archiveDir); err == nil {
+			return "", fmt.Errorf("unable to rotate %s - %s already exists", collection, archive)
+		}
+		if err := os.Rename(dir, archiveDir); err != nil {
+			return "", err
+		}
+		if err := os.MkdirAll(dir, d.dirMode()); err != nil {
+			return "", err
+		}
+		if err := d.copyCollectionFiles(archiveDir, dir, nil); err != nil {
+			return "", err
+		}
+		if d.durable {
+			if err := syncDir(d.Dir()); err != nil {
+				return "", err
+			}
+		}
+
+		d.cache.removeCollection(collection)
+		d.unindex(collection, "")
+		d.notify(OpDelete, collection, "")
+		d.bumpVersion(collection)
+		return archive, d.logChange(OpDelete, collection, "", nil)
+	})
+}
+
+// KeySnapshot returns the collection's resource keys with their files'
+// modification times in Unix nanoseconds, for DiffKeySnapshot to compare
+// against later.
+func (d *Driver) KeySnapshot(collection string) (map[string]int64, error) {
+	snapshot := make(map[string]int64)
+	err := d.eachRecordFile(collection, func(resource, path string, fi os.FileInfo) error {
+		snapshot[resource] = fi.ModTime().UnixNano()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+// DiffKeySnapshot compares a snapshot taken by KeySnapshot with the
+// collection as it is now, returning in name order the keys added since,
+// those removed and those whose file has a different modification time.
+func (d *Driver) DiffKeySnapshot(collection string, old map[string]int64) (added, removed, changed []string, err error) {
+	current, err := d.KeySnapshot(collection)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	for resource, modTime := range current {
+		if prev, ok := old[resource]; !ok {
+			added = append(added, resource)
+		} else if prev != modTime {
+			changed = append(changed, resource)
+		}
+	}
+	for resource := range old {
+		if _, ok := current[resource]; !ok {
+			removed = append(removed, resource)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+
+	return added, removed, changed, nil
+}
+
+// FindDuplicates groups the records of a collection whose encoded contents
+// are byte for byte identical. The result maps a SHA-256 of the contents to
+// the resources sharing it and only holds groups of two or more.
+func (d *Driver) FindDuplicates(collection string) (map[string][]string, error) {
+	groups := make(map[string][]string)
+
+	err := d.eachRecordFile(collection, func(resource, path string, fi os.FileInfo) error {
+		sum, err := d.hashRecordFile(path)
+		if err != nil {
+			return err
+		}
+
+		groups[sum] = append(groups[sum], resource)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for sum, resources := range groups {
+		if len(resources) < 2 {
+			delete(groups, sum)
+		}
+	}
+
+	return groups, nil
+}
+
+// Append adds item to the end of the JSON array stored in the record,
+// creating the record as a one element array if it doesn't exist yet. The
+// read, append and write happen under the collection's lock, so concurrent
+// appends are never lost.
+func (d *Driver) Append(collection, resource string, item interface{}) error {
+	if collection == "" {
+		return fmt.Errorf("missing collection - no place to save record")
+	}
+	if resource == "" {
+		return fmt.Errorf("missing resource - unable to save")
+	}
+	if err := d.checkResource(resource); err != nil {
+		return err
+	}
+
+	raw, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+
+	return d.withTimeout(func() error {
+		mutex := d.lockCollection(collection)
+		defer mutex.Unlock()
+
+		items, err := d.readArray(collection, resource)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		b, err := d.encode(collection, append(items, raw))
+		if err != nil {
+			return err
+		}
+
+		return d.writeRecord(collection, resource, b)
+	})
+}
+
+// Pop removes the first element of the JSON array stored in the record and
+// returns it, writing the remainder back atomically. It returns ErrEmpty if
+// the array is empty or the record doesn't exist. Together with Append this
+// makes the record a FIFO queue.
+func (d *Driver) Pop(collection, resource string) (json.RawMessage, error) {
+	if collection == "" {
+		return nil, fmt.Errorf("missing collection - no place to read record")
+	}
+	if resource == "" {
+		return nil, fmt.Errorf("missing resource - unable to read")
+	}
+	if err := d.checkResource(resource); err != nil {
+		return nil, err
+	}
+
+	return timed(d, func() (json.RawMessage, error) {
+		return d.pop(collection, resource)
+	})
+}
+
+func (d *Driver) pop(collection, resource string) (json.RawMessage, error) {
+	mutex := d.lockCollection(collection)
+	defer mutex.Unlock()
+
+	items, err := d.readArray(collection, resource)
+	if os.IsNotExist(err) {
+		return nil, ErrEmpty
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, ErrEmpty
+	}
+
+	b, err := d.encode(collection, append([]json.RawMessage{}, items[1:]...))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.writeRecord(collection, resource, b); err != nil {
+		return nil, err
+	}
+
+	return items[0], nil
+}
+
+// readArray reads a record holding a JSON array. The caller must hold the
+// collection's mutex.
+func (d *Driver) readArray(collection, resource string) ([]json.RawMessage, error) {
+	path, _, err := d.recordFile(collection, resource)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := d.readRecordFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []json.RawMessage
+	if err := d.decode(collection, b, &items); err != nil {
+		return nil, fmt.Errorf("record %s/%s is not a JSON array: %w", collection, resource, err)
+	}
+
+	return items, nil
+}
+
+func (d *Driver) Delete(collection, resource string) error {
+	return d.withTimeout(func() error {
+		return d.delete(collection, resource)
+	})
+}
+
+func (d *Driver) delete(collection, resource string) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	if resource != "" {
+		if err := d.checkResource(resource); err != nil {
+			return err
+		}
+	}
+
+	unlock := d.lockDelete(collection)
+	defer unlock()
+
+	return d.deleteLocked(collection, resource)
+}
+
+// PruneOlderThan deletes the records in the collection last written more
+// than maxAge ago, going by their files' modification times, and returns
+// how many it deleted. The collection stays locked throughout.
+func (d *Driver) PruneOlderThan(collection string, maxAge time.Duration) (removed int, err error) {
+	if collection == "" {
+		return 0, fmt.Errorf("missing collection - no place to delete records")
+	}
+	if err := d.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	return timed(d, func() (int, error) {
+		unlock := d.lockDelete(collection)
+		defer unlock()
+
+		cutoff := time.Now().Add(-maxAge)
+
+		var stale []string
+		err := d.eachRecordFile(collection, func(resource, path string, fi os.FileInfo) error {
+			if fi.ModTime().Before(cutoff) {
+				stale = append(stale, resource)
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+
+		removed := 0
+		for _, resource := range stale {
+			if err := d.deleteLocked(collection, resource); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+
+		return removed, nil
+	})
+}
+
+// DeleteAndReturn decodes a record into v and deletes it, holding the
+// collection's lock throughout so no write can land in between. If the
+// record doesn't exist, or can't be decoded into v, nothing is deleted.
+func (d *Driver) DeleteAndReturn(collection, resource string, v interface{}) error {
+	if collection == "" {
+		return fmt.Errorf("missing collection - no place to delete record")
+	}
+	if resource == "" {
+		return fmt.Errorf("missing resource - unable to delete")
+	}
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	if err := d.checkResource(resource); err != nil {
+		return err
+	}
+
+	unlock := d.lockDelete(collection)
+	defer unlock()
+
+	b, err := d.readRecordLocked(collection, strings.TrimSuffix(resource, d.codec.Ext()))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: %s/%s", ErrRecordNotFound, collection, resource)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := d.decodeRead(collection, resource, b, v); err != nil {
+		return err
+	}
+
+	return d.deleteLocked(collection, resource)
+}
+
+// deleteLocked removes a record, or the whole collection when resource is
+// empty, once the references other collections hold to it allow. The
+// caller must hold the mutexes lockDelete takes for the collection.
+func (d *Driver) deleteLocked(collection, resource string) error {
+	if refs := d.referencesTo(collection); len(refs) > 0 {
+		return d.deleteReferenced(collection, resource, refs)
+	}
+
+	return d.removeLocked(collection, resource)
+}
+
+// removeLocked is deleteLocked without the reference checks.
+func (d *Driver) removeLocked(collection, resource string) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+
+	path := filepath.Join(collection, resource)
+	dir := filepath.Join(d.Dir(), path)
+
+	var err error
+	var removedDir bool
+	switch fi, statErr := d.stat(dir); {
+	case fi == nil && statErr != nil:
+		d.cache.remove(collection, strings.TrimSuffix(resource, d.codec.Ext()))
+		return fmt.Errorf("unable to find file or directory named %s", path)
+	case fi.Mode().IsDir():
+		err = os.RemoveAll(dir)
+		removedDir = true
+	case fi.Mode().IsRegular():
+		if d.keepBackup {
+			if err := backupRecord(d.recordPath(collection, strings.TrimSuffix(resource, d.codec.Ext()))); err != nil {
+				return err
+			}
+		}
+		err = d.removeRecord(collection, resource)
+	default:
+		return nil
+	}
+
+	if err == nil {
+		if removedDir {
+			d.cache.removeCollection(filepath.ToSlash(path))
+		} else {
+			d.cache.remove(collection, strings.TrimSuffix(resource, d.codec.Ext()))
+		}
+		d.unindex(collection, resource)
+		d.notify(OpDelete, collection, resource)
+		atomic.AddUint64(&d.metrics.deletes, 1)
+		d.bumpVersion(collection)
+		err = d.logChange(OpDelete, collection, strings.TrimSuffix(resource, d.codec.Ext()), nil)
+	}
+
+	return err
+}
+
+// WithExclusive runs fn while every collection is locked and no new
+// collection can be created, so fn sees a database no other goroutine is
+// changing. Other operations wait until fn returns. Locks are taken in
+// collection name order and the Driver's own mutex last; see lockAll.
+//
+// fn must work on the files under Dir directly: calling back into the
+// Driver from fn deadlocks.
+func (d *Driver) WithExclusive(fn func() error) error {
+	unlock := d.lockAll()
+	defer unlock()
+
+	return fn()
+}
+
+// lockAll locks every collection and then the Driver's own mutex, which
+// keeps new collections from being created. Collection locks are always
+// taken in name order and before the Driver mutex, matching the order every
+// other operation uses, so lockAll can't deadlock with them: if a
+// collection appears while they are being taken, lockAll releases them all
+// and starts over rather than lock it out of order. It returns a
+// function releasing everything. With MutexStripes it locks every stripe,
+// in order, instead.
+func (d *Driver) lockAll() func() {
+	if d.stripes != nil {
+		for i := range d.stripes {
+			d.stripes[i].Lock()
+		}
+		d.mutex.Lock()
+
+		return func() {
+			d.mutex.Unlock()
+			for i := range d.stripes {
+				d.stripes[i].Unlock()
+			}
+		}
+	}
+
+	for {
+		d.mutex.Lock()
+		collections := make([]string, 0, len(d.mutexes))
+		for collection := range d.mutexes {
+			collections = append(collections, collection)
+		}
+		d.mutex.Unlock()
+		sort.Strings(collections)
+
+		held := make(map[string]*sync.Mutex, len(collections))
+		for _, collection := range collections {
+			held[collection] = d.lockCollection(collection)
+		}
+
+		// Collections created while the snapshot was being locked would
+		// have to be locked out of order, so start over instead.
+		d.mutex.Lock()
+		if sameMutexes(d.mutexes, held) {
+			return func() {
+				d.mutex.Unlock()
+				for _, m := range held {
+					m.Unlock()
+				}
+			}
+		}
+		d.mutex.Unlock()
+
+		for _, m := range held {
+			m.Unlock()
+		}
+	}
+}
+
+// sameMutexes reports whether held is exactly the set of mutexes in
+// mutexes.
+func sameMutexes(mutexes, held map[string]*sync.Mutex) bool {
+	if len(mutexes) != len(held) {
+		return false
+	}
+	for collection, m := range mutexes {
+		if held[collection] != m {
+			return false
+		}
+	}
+	return true
+}
+
+// CollectionCounts returns the number of records in every collection,
+// reading the database directory tree once.
+func (d *Driver) CollectionCounts() (map[string]int, error) {
+	collections, err := d.collections()
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int)
+	for _, collection := range collections {
+		n, err := d.countRecords(collection)
+		if err != nil {
+			return nil, err
+		}
+		counts[collection] = n
+	}
+
+	return counts, nil
+}
+
+// CollectionStat is a collection's size on disk as CollectionsBySize
+// reports it. Bytes counts record files only, as stored.
+type CollectionStat struct {
+	Name    string
+	Bytes   int64
+	Records int
+}
+
+// CollectionsBySize returns every collection with its size and record
+// count, largest first, walking each collection's files once.
+func (d *Driver) CollectionsBySize() ([]CollectionStat, error) {
+	collections, err := d.collections()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make([]CollectionStat, 0, len(collections))
+	for _, collection := range collections {
+		stat := CollectionStat{Name: collection}
+		err := d.eachRecordFile(collection, func(resource, path string, fi os.FileInfo) error {
+			stat.Bytes += fi.Size()
+			stat.Records++
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, stat)
+	}
+
+	sort.SliceStable(stats, func(i, j int) bool {
+		return stats[i].Bytes > stats[j].Bytes
+	})
+
+	return stats, nil
+}
+
+// KeySizes returns the size on disk of every record in the collection,
+// keyed by resource, from the files' metadata alone. Compressed records
+// report their compressed size.
+func (d *Driver) KeySizes(collection string) (map[string]int64, error) {
+	sizes := make(map[string]int64)
+	err := d.eachRecordFile(collection, func(resource, path string, fi os.FileInfo) error {
+		sizes[resource] = fi.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sizes, nil
+}
+
+// EstimateCount returns the number of records in a collection, taking the
+// cheapest source available. Collections keep no manifest to estimate
+// from, so for now this is always the exact count.
+func (d *Driver) EstimateCount(collection string) (int, error) {
+	if collection == "" {
+		return 0, fmt.Errorf("missing collection - no place to read record")
+	}
+
+	return d.countRecords(collection)
+}
+
+func (d *Driver) countRecords(collection string) (int, error) {
+	n := 0
+	err := d.eachRecordFile(collection, func(resource, path string, fi os.FileInfo) error {
+		n++
+		return nil
+	})
+
+	return n, err
+}
+
+// OrphanedFiles lists, without removing anything, the files in collection
+// directories that aren't records: temp files left by interrupted writes
+// and files that don't carry the codec's extension. KeepBackup's backups
+// aren't orphans.
+func (d *Driver) OrphanedFiles() ([]string, error) {
+	collections, err := d.collections()
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []string
+	for _, collection := range collections {
+		dir := filepath.Join(d.Dir(), collection)
+
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			if file.IsDir() || d.isRecordFile(file) || isInternal(file.Name()) || strings.HasSuffix(file.Name(), backupExt) {
+				continue
+			}
+			orphans = append(orphans, filepath.Join(dir, file.Name()))
+		}
+	}
+
+	return orphans, nil
+}
+
+// NeedsRecovery reports whether the last process using the database left
+// work unfinished: temp files of interrupted writes, staging directories
+// of an interrupted ReplaceCollection, or snapshots that were never
+// closed. It returns their paths relative to Dir, in name order. Nothing
+// is changed.
+func (d *Driver) NeedsRecovery() (bool, []string, error) {
+	dir := d.Dir()
+
+	var leftovers []string
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name := fi.Name()
+		leftover := strings.HasSuffix(name, ".tmp")
+		if fi.IsDir() {
+			leftover = strings.HasSuffix(name, replacingSuffix) || strings.HasSuffix(name, replacedSuffix) ||
+				strings.HasSuffix(name, snapshotSuffix)
+		}
+		if !leftover {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		leftovers = append(leftovers, filepath.ToSlash(rel))
+
+		if fi.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return false, nil, err
+	}
+
+	return len(leftovers) > 0, leftovers, nil
+}
+
+// collections returns the names of all collections in name order.
+func (d *Driver) collections() ([]string, error) {
+	entries, err := ioutil.ReadDir(d.Dir())
+	if err != nil {
+		return nil, err
+	}
+
+	var collections []string
+	for _, entry := range entries {
+		if entry.IsDir() && !isInternal(entry.Name()) {
+			collections = append(collections, entry.Name())
+		}
+	}
+
+	return collections, nil
+}
+
+func (d *Driver) getOrCreateMutex(collection string) *sync.Mutex {
+	if d.stripes != nil {
+		h := fnv.New32a()
+		h.Write([]byte(collection))
+		return &d.stripes[h.Sum32()%uint32(len(d.stripes))]
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	m, ok := d.mutexes[collection]
+	if !ok {
+		m = &sync.Mutex{}
+		d.mutexes[collection] = m
+	}
+
+	if d.maxOpen > 0 {
+		d.pins[collection]++
+		if el, ok := d.openItems[collection]; ok {
+			d.openOrder.MoveToFront(el)
+		} else {
+			d.openItems[collection] = d.openOrder.PushFront(collection)
+			d.evictMutexes()
+		}
+	}
+
+	return m
+}
+
+// unpin undoes the pin getOrCreateMutex puts on a mutex under
+// MaxOpenCollections, once the caller has locked it or given up.
+func (d *Driver) unpin(collection string) {
+	if d.maxOpen <= 0 || d.stripes != nil {
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.pins[collection]--; d.pins[collection] <= 0 {
+		delete(d.pins, collection)
+	}
+}
+
+// evictMutexes drops the least recently used collection mutexes until at
+// most MaxOpenCollections are left, skipping any that are pinned or held:
+// a mutex nobody is about to lock and that TryLock can take has no users,
+// and the next access creates a new one. The caller must hold d.mutex.
+func (d *Driver) evictMutexes() {
+	for el := d.openOrder.Back(); el != nil && len(d.mutexes) > d.maxOpen; {
+		prev := el.Prev()
+
+		collection := el.Value.(string)
+		if m := d.mutexes[collection]; d.pins[collection] == 0 && m.TryLock() {
+			m.Unlock()
+			delete(d.mutexes, collection)
+			delete(d.openItems, collection)
+			d.openOrder.Remove(el)
+		}
+
+		el = prev
+	}
+}
+
+// lockCollection locks the collection's mutex and returns it to be
+// unlocked, timing the wait when LockStats is set.
+func (d *Driver) lockCollection(collection string) *sync.Mutex {
+	if !d.lockStats {
+		mutex := d.getOrCreateMutex(collection)
+		mutex.Lock()
+		d.unpin(collection)
+		return mutex
+	}
+
+	start := time.Now()
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	d.unpin(collection)
+	d.recordLockWait(collection, time.Since(start))
+
+	return mutex
+}
+
+// SetFieldMap makes the collection store top-level keys under shorter names.
+// mapping goes from the field name used by callers to the name kept on disk;
+// Write applies it and Read and ReadAll reverse it. A nil mapping removes it.
+// A collection with a field map can't hold SelfMarshaler records.
+func (d *Driver) SetFieldMap(collection string, mapping map[string]string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if mapping == nil {
+		delete(d.fieldMaps, collection)
+		return
+	}
+
+	m := make(map[string]string, len(mapping))
+	for long, short := range mapping {
+		m[long] = short
+	}
+	d.fieldMaps[collection] = m
+}
+
+func (d *Driver) fieldMap(collection string) map[string]string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.fieldMaps[collection]
+}
+
+// withTimeout is timed for operations that only return an error.
+func (d *Driver) withTimeout(op func() error) error {
+	_, err := timed(d, func() (struct{}, error) {
+		return struct{}{}, op()
+	})
+	return err
+}
+
+// timed runs op, returning early with context.DeadlineExceeded if it
+// outlasts the configured OperationTimeout. op hands its results back
+// through a channel instead of setting the caller's variables, since it
+// may keep running after timed returns.
+func timed[T any](d *Driver, op func() (T, error)) (T, error) {
+	if d.timeout <= 0 {
+		return op()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+
+	type result struct {
+		v   T
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		v, err := op()
+		done <- result{v, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.v, r.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// prepare runs the configured Transform on a record passed in by a caller
+// and encodes the result, applying RejectEmptyRecords.
+func (d *Driver) prepare(collection, resource string, v interface{}) ([]byte, error) {
+	if d.transform != nil {
+		var err error
+		if v, err = d.transform(collection, resource, v); err != nil {
+			return nil, err
+		}
+	}
+
+	b, err := d.encode(collection, v)
+	if err != nil {
+		return nil, err
+	}
+
+	if b, err = d.applySchema(collection, resource, b); err != nil {
+		return nil, err
+	}
+
+	if d.rejectEmpty && isEmptyRecord(b) {
+		return nil, fmt.Errorf("%w: %s/%s", ErrEmptyRecord, collection, resource)
+	}
+
+	return b, nil
+}
+
+// checkInput applies MaxInputBytes and MaxInputDepth to encoded bytes
+// coming from outside the Driver. The depth is only checked for JSON.
+func (d *Driver) checkInput(name string, b []byte) error {
+	if d.maxInput > 0 && len(b) > d.maxInput {
+		return fmt.Errorf("%w: %s is over %d bytes", ErrInputTooComplex, name, d.maxInput)
+	}
+
+	if _, ok := d.codec.(JSONCodec); !ok || d.maxDepth <= 0 {
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s is not valid JSON: %w", name, err)
+		}
+
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			if depth++; depth > d.maxDepth {
+				return fmt.Errorf("%w: %s is nested over %d levels deep", ErrInputTooComplex, name, d.maxDepth)
+			}
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+}
+
+func isEmptyRecord(b []byte) bool {
+	switch string(bytes.TrimSpace(b)) {
+	case "", "null", "{}":
+		return true
+	}
+	return false
+}
+
+// encode turns v into the encoded bytes of a record of collection.
+// Compression is left to storeRecord.
+func (d *Driver) encode(collection string, v interface{}) ([]byte, error) {
+	mapping := d.fieldMap(collection)
+
+	if m, ok := selfMarshaler(v); ok {
+		if mapping != nil {
+			return nil, fmt.Errorf("unable to store %T in %s - SelfMarshaler records can't be field mapped", v, collection)
+		}
+		return m.MarshalRecord()
+	}
+
+	b, err := d.codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	if mapping != nil {
+		if b, err = renameFields(b, mapping); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, ok := d.codec.(JSONCodec); ok && d.canonical {
+		if b, err = canonicalize(b); err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// decode is the inverse of encode.
+func (d *Driver) decode(collection string, b []byte, v interface{}) error {
+	if m, ok := v.(SelfMarshaler); ok {
+		return m.UnmarshalRecord(b)
+	}
+
+	b, err := d.plain(collection, b)
+	if err != nil {
+		return err
+	}
+
+	return d.codec.Unmarshal(b, v)
+}
+
+// decodeRead is decode for records handed back to callers, which also runs
+// the PostRead hook.
+func (d *Driver) decodeRead(collection, resource string, b []byte, v interface{}) error {
+	if err := d.decode(collection, b, v); err != nil {
+		return err
+	}
+
+	if d.postRead != nil {
+		return d.postRead(collection, resource, v)
+	}
+	return nil
+}
+
+// selfMarshaler returns v as a SelfMarshaler. A value whose methods have
+// pointer receivers is copied so they can be called on it, keeping Write
+// and Read symmetric whether the caller passes a value or a pointer.
+func selfMarshaler(v interface{}) (SelfMarshaler, bool) {
+	if m, ok := v.(SelfMarshaler); ok {
+		return m, true
+	}
+
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		return nil, false
+	}
+
+	p := reflect.New(rv.Type())
+	p.Elem().Set(rv)
+	m, ok := p.Interface().(SelfMarshaler)
+	return m, ok
+}
+
+// plain undoes what encode does on top of the codec, returning the bytes
+// the codec produced.
+func (d *Driver) plain(collection string, b []byte) ([]byte, error) {
+	mapping := d.fieldMap(collection)
+	if mapping == nil {
+		return b, nil
+	}
+
+	reverse := make(map[string]string, len(mapping))
+	for long, short := range mapping {
+		reverse[short] = long
+	}
+
+	return renameFields(b, reverse)
+}
+
+// renameFields renames the top-level keys of a JSON object. Anything that
+// isn't an object is returned untouched.
+func renameFields(b []byte, names map[string]string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil || fields == nil {
+		return b, nil
+	}
+
+	renamed := make(map[string]json.RawMessage, len(fields))
+	for k, v := range fields {
+		if name, ok := names[k]; ok {
+			k = name
+		}
+		renamed[k] = v
+	}
+
+	return marshal(renamed)
+}
+
+// canonicalize re-encodes JSON with the keys of every object sorted.
+// Numbers are kept exactly as they were written.
+func canonicalize(b []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	return marshal(v)
+}
+
+// compressedExt follows the codec's extension in the name of a record
+// stored gzipped.
+const compressedExt = ".gz"
+
+// backupExt follows the full name of a record file in the name of the
+// previous version KeepBackup keeps of it.
+const backupExt = ".bak"
+
+func compress(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decompress(b []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	return ioutil.ReadAll(zr)
+}
+
+func marshal(v interface{}) ([]byte, error) {
+	b, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(b, byte('\n')), nil
+}
+
+// recordPath returns the path of a record stored uncompressed.
+func (d *Driver) recordPath(collection, resource string) string {
+	return filepath.Join(d.Dir(), collection, strings.TrimSuffix(resource, d.codec.Ext())) + d.codec.Ext()
+}
+
+// recordFile finds the file holding a record, which carries compressedExt
+// when the record was compressed.
+func (d *Driver) recordFile(collection, resource string) (string, os.FileInfo, error) {
+	path := d.recordPath(collection, resource)
+
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		if gzfi, gzerr := os.Stat(path + compressedExt); gzerr == nil {
+			return path + compressedExt, gzfi, nil
+		}
+	}
+
+	return path, fi, err
+}
+
+// readRecordFile returns the encoded bytes held in a record file,
+// decompressing them if the file is compressed.
+func (d *Driver) readRecordFile(path string) ([]byte, error) {
+	release := d.acquireFile()
+	b, err := d.storage.ReadFile(path)
+	release()
+	atomic.AddUint64(&d.metrics.readBytes, uint64(len(b)))
+
+	if err != nil || !strings.HasSuffix(path, compressedExt) {
+		return b, err
+	}
+
+	return decompress(b)
+}
+
+// openRecordFile is like readRecordFile but streams the encoded bytes.
+func (d *Driver) openRecordFile(path string) (io.ReadCloser, error) {
+	release := d.acquireFile()
+
+	f, err := os.Open(path)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	r := &recordReader{Reader: f, f: f, release: release}
+	if strings.HasSuffix(path, compressedExt) {
+		if r.Reader, err = gzip.NewReader(f); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// recordReader streams a record file opened by openRecordFile.
+type recordReader struct {
+	io.Reader
+	f       *os.File
+	release func()
+}
+
+func (r *recordReader) Close() error {
+	err := r.f.Close()
+	r.release()
+	r.release = func() {}
+	return err
+}
+
+// acquireFile waits until a record file may be opened under
+// MaxConcurrentFiles and returns a function to call once it is closed.
+func (d *Driver) acquireFile() func() {
+	if d.files == nil {
+		return func() {}
+	}
+
+	d.files <- struct{}{}
+	return func() { <-d.files }
+}
+
+// storeRecord writes a record's encoded bytes to path, gzipped under the
+// compressed name when they exceed the collection's compression threshold,
+// and then removes the record's file in the other form in case it was
+// stored that way before.
+func (d *Driver) storeRecord(collection, path string, b []byte) error {
+	target, other := path, path+compressedExt
+	if over := d.compressThreshold(collection); over > 0 && len(b) > over {
+		var err error
+		if b, err = compress(b); err != nil {
+			return err
+		}
+		target, other = other, target
+	}
+
+	if err := d.writeFile(target, b); err != nil {
+		return err
+	}
+
+	if err := os.Remove(other); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// backupRecord hard links the record stored at path, in whichever form it
+// is stored, to the same name with backupExt added, replacing any older
+// backup. The record itself stays in place until it is overwritten.
+func backupRecord(path string) error {
+	for _, name := range []string{path, path + compressedExt} {
+		if err := os.Remove(name + backupExt); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	for _, name := range []string{path, path + compressedExt} {
+		err := os.Link(name, name+backupExt)
+		if err == nil || !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Rollback restores the version of a record kept by KeepBackup, undoing the
+// last write or delete of it, and discards the backup. It returns
+// ErrRecordNotFound if there is no backup to restore.
+func (d *Driver) Rollback(collection, resource string) error {
+	if collection == "" {
+		return fmt.Errorf("missing collection - no place to restore record")
+	}
+	if err := d.checkResource(resource); err != nil {
+		return err
+	}
+
+	return d.withTimeout(func() error {
+		mutex := d.lockCollection(collection)
+		defer mutex.Unlock()
+
+		if err := d.checkWritable(); err != nil {
+			return err
+		}
+
+		path := d.recordPath(collection, resource)
+
+		b, err := ioutil.ReadFile(path + backupExt)
+		if os.IsNotExist(err) {
+			if b, err = ioutil.ReadFile(path + compressedExt + backupExt); err == nil {
+				b, err = decompress(b)
+			}
+		}
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no backup of %s/%s: %w", collection, resource, ErrRecordNotFound)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := d.writeRecord(collection, resource, b); err != nil {
+			return err
+		}
+
+		for _, name := range []string{path, path + compressedExt} {
+			if err := os.Remove(name + backupExt); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// removeRecord removes a record's file in whichever form it was stored.
+func (d *Driver) removeRecord(collection, resource string) error {
+	path := d.recordPath(collection, resource)
+
+	for _, name := range []string{path, path + compressedExt} {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeFile writes b to a temp file next to path and renames it into place,
+// so readers never observe a partially written record.
+func (d *Driver) writeFile(path string, b []byte) error {
+	tempPath := path + ".tmp"
+
+	f, err := d.openFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, d.fileMode())
+	if err != nil {
+		return diskFull(path, err)
+	}
+
+	// A failed write may leave a partial temp file behind; the record
+	// itself is only replaced by the rename.
+	fail := func(err error) error {
+		f.Close()
+		os.Remove(tempPath)
+		return diskFull(path, err)
+	}
+
+	if _, err := f.Write(b); err != nil {
+		return fail(err)
+	}
+
+	if d.durable {
+		if err := f.Sync(); err != nil {
+			return fail(err)
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tempPath)
+		return diskFull(path, err)
+	}
+
+	if d.beforeRename != nil {
+		d.beforeRename(path)
+	}
+
+	return os.Rename(tempPath, path)
+}
+
+func (d *Driver) openFile(name string, flag int, perm os.FileMode) (writableFile, error) {
+	if s, ok := d.storage.(writeStorage); ok {
+		return s.OpenFile(name, flag, perm)
+	}
+	return os.OpenFile(name, flag, perm)
+}
+
+// diskFull reports a write that ran out of space as ErrDiskFull, keeping
+// other errors as they are.
+func diskFull(path string, err error) error {
+	if errors.Is(err, syscall.ENOSPC) {
+		return fmt.Errorf("%w: unable to write %s: %v", ErrDiskFull, path, err)
+	}
+	return err
+}
+
+// Digest returns a SHA-256 over every collection and record in the database,
+// taken in name order, so two databases with the same contents produce the
+// same digest. Temp and internal files are left out. The whole database is
+// locked while it is hashed, so the digest matches a single point in time.
+func (d *Driver) Digest() (string, error) {
+	unlock := d.lockAll()
+	defer unlock()
+
+	collections, err := d.collections()
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	for _, collection := range collections {
+		fmt.Fprintf(h, "collection %d %s\n", len(collection), collection)
+
+		err := d.eachRecord(collection, func(resource string, b []byte) error {
+			fmt.Fprintf(h, "record %d %s %d\n", len(resource), resource, len(b))
+			h.Write(b)
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// copyTree copies the directory tree at src to dst, keeping file modes and
+// modification times.
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if fi.IsDir() {
+			return os.MkdirAll(target, fi.Mode().Perm())
+		}
+
+		if err := copyFile(path, target, fi.Mode().Perm()); err != nil {
+			return err
+		}
+
+		return os.Chtimes(target, fi.ModTime(), fi.ModTime())
+	})
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+func hashBytes(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// hashRecordFile returns the hex encoded SHA-256 of the encoded bytes held
+// in a record file.
+func (d *Driver) hashRecordFile(path string) (string, error) {
+	f, err := d.openRecordFile(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// FlushCollection fsyncs every record file of the collection and the
+// directories holding them, so records written without Durable are safe
+// on disk once it returns. Other collections aren't touched.
+func (d *Driver) FlushCollection(collection string) error {
+	if collection == "" {
+		return fmt.Errorf("missing collection - no place to flush")
+	}
+
+	return d.withTimeout(func() error {
+		mutex := d.lockCollection(collection)
+		defer mutex.Unlock()
+
+		dirs := map[string]bool{filepath.Join(d.Dir(), collection): true}
+		err := d.eachRecordFile(collection, func(resource, path string, fi os.FileInfo) error {
+			dirs[filepath.Dir(path)] = true
+			return d.flushPath(path)
+		})
+		if err != nil {
+			return err
+		}
+
+		for dir := range dirs {
+			if err := d.flushPath(dir); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (d *Driver) flushPath(path string) error {
+	if d.beforeSync != nil {
+		d.beforeSync(path)
+	}
+
+	return syncDir(path)
+}
+
+// syncDir fsyncs dir. It works on a regular file just as well.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
+
+// internalNames are the files the Driver keeps in the database and
+// collection directories for its own bookkeeping.
+var internalNames = map[string]bool{
+	changeLogFile: true,
+	appliedFile:   true,
+	archivedFile:  true,
+	versionsFile:  true,
+	configFile:    true,
+	seqFile:       true,
+}
+
+// ReplaceCollection stages the new records, and parks the old ones, in
+// directories named after the collection with these suffixes.
+const (
+	replacingSuffix = ".replacing"
+	replacedSuffix  = ".replaced"
+)
+
+// snapshotSuffix ends the directories BackupConcurrent links records into.
+const snapshotSuffix = ".snapshot"
+
+// isInternal reports whether name is one of the Driver's own files or
+// directories rather than a collection or record. Any other name,
+// including one starting with an underscore or a dot, belongs to the
+// caller.
+func isInternal(name string) bool {
+	return internalNames[name] || strings.HasSuffix(name, replacingSuffix) || strings.HasSuffix(name, replacedSuffix) ||
+		strings.HasSuffix(name, snapshotSuffix)
+}
+
+// isRecordFile reports whether file holds a record, as opposed to a
+// directory, a temp file left by an interrupted write or an internal file.
+func (d *Driver) isRecordFile(file os.FileInfo) bool {
+	name := strings.TrimSuffix(file.Name(), compressedExt)
+	return file.Mode().IsRegular() && strings.HasSuffix(name, d.codec.Ext()) && !isInternal(file.Name())
+}
+
+// checkResource rejects resource keys that would leave their collection's
+// directory. With HierarchicalKeys a key may hold "/" separated segments,
+// none of which may be empty, "." or "..".
+func (d *Driver) checkResource(resource string) error {
+	segments := []string{resource}
+	if d.hierarchical {
+		segments = strings.Split(resource, "/")
+	}
+
+	for _, segment := range segments {
+		if segment == "" || segment == "." || segment == ".." || strings.ContainsAny(segment, "/"+string(os.PathSeparator)) {
+			return fmt.Errorf("%w: %q", ErrInvalidKey, resource)
+		}
+	}
+
+	if isInternal(segments[len(segments)-1] + d.codec.Ext()) {
+		return fmt.Errorf("%w: %q is reserved", ErrInvalidKey, resource)
+	}
+
+	return d.keyPolicy.check(resource)
+}
+
+// KeyPolicy is a set of rules resource keys must follow, on top of those
+// keeping them inside their collection. Keys that break one fail with
+// ErrInvalidName.
+type KeyPolicy struct {
+	// MaxLength, if set, is the longest a key may be, in bytes.
+	MaxLength int
+
+	// Allowed, if set, must match the key. Anchor it with ^ and $ to
+	// restrict every character.
+	Allowed *regexp.Regexp
+}
+
+// DefaultKeyPolicy keeps keys short enough for any filesystem's file names,
+// once the codec's extension is added, and free of control characters.
+var DefaultKeyPolicy = KeyPolicy{
+	MaxLength: 200,
+	Allowed:   regexp.MustCompile(`^[^\x00-\x1f\x7f]+$`),
+}
+
+func (p KeyPolicy) check(resource string) error {
+	if p.MaxLength > 0 && len(resource) > p.MaxLength {
+		return fmt.Errorf("%w: %q is longer than %d bytes", ErrInvalidName, resource, p.MaxLength)
+	}
+	if p.Allowed != nil && !p.Allowed.MatchString(resource) {
+		return fmt.Errorf("%w: %q doesn't match %s", ErrInvalidName, resource, p.Allowed)
+	}
+	return nil
+}
+
+func (d *Driver) stat(path string) (fi os.FileInfo, err error) {
+	if fi, err = os.Stat(path); os.IsNotExist(err) {
+		fi, err = os.Stat(path + d.codec.Ext())
+	}
+	if os.IsNotExist(err) {
+		fi, err = os.Stat(path + d.codec.Ext() + compressedExt)
 	}
 	return
 }
@@ -0,0 +1,2366 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newTestDriver(t testing.TB, options *Options) *Driver {
+	t.Helper()
+
+	db, err := New(filepath.Join(t.TempDir(), "db"), options)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	return db
+}
+
+func TestNewReopensExistingDirectory(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "nested", "db")
+
+	db, err := New(dir, nil)
+	if err != nil {
+		t.Fatalf("New on missing directory: %v", err)
+	}
+	if err := db.Write("users", "Eren", User{Name: "Eren"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	reopened, err := New(dir, nil)
+	if err != nil {
+		t.Fatalf("New on existing directory: %v", err)
+	}
+
+	var u User
+	if err := reopened.Read("users", "Eren", &u); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if u.Name != "Eren" {
+		t.Errorf("Name = %q, want Eren", u.Name)
+	}
+}
+
+func TestWriteBatchDurable(t *testing.T) {
+	db := newTestDriver(t, &Options{Durable: true})
+
+	records := make(map[string]interface{})
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("user%02d", i)
+		records[name] = User{Name: name}
+	}
+	if err := db.WriteBatch("users", records); err != nil {
+		t.Fatalf("WriteBatch: %v", err)
+	}
+
+	for name := range records {
+		var u User
+		if err := db.Read("users", name, &u); err != nil {
+			t.Fatalf("Read %s: %v", name, err)
+		}
+		if u.Name != name {
+			t.Errorf("Name = %q, want %q", u.Name, name)
+		}
+	}
+}
+
+func TestWriteIsAtomicToReaders(t *testing.T) {
+	db := newTestDriver(t, nil)
+
+	// midWrite reads the record while the temp file is complete but not
+	// yet renamed into place.
+	var readErr error
+	var midWrite User
+	db.beforeRename = func(path string) {
+		if filepath.Base(path) != "Eren.json" {
+			return
+		}
+		midWrite = User{}
+		readErr = db.Read("users", "Eren", &midWrite)
+
+		var pending User
+		b, err := ioutil.ReadFile(path + ".tmp")
+		if err != nil {
+			t.Fatalf("reading temp file: %v", err)
+		}
+		if err := json.Unmarshal(b, &pending); err != nil {
+			t.Errorf("temp file %s is not a complete record: %v", b, err)
+		}
+	}
+
+	if err := db.Write("users", "Eren", User{Name: "Eren", Age: "19"}); err != nil {
+		t.Fatalf("first Write: %v", err)
+	}
+	if !os.IsNotExist(readErr) {
+		t.Errorf("Read during first write = %+v, %v, want not found", midWrite, readErr)
+	}
+
+	if err := db.Write("users", "Eren", User{Name: "Eren", Age: "20"}); err != nil {
+		t.Fatalf("second Write: %v", err)
+	}
+	if readErr != nil || midWrite.Age != "19" {
+		t.Errorf("Read during second write = %+v, %v, want the old record", midWrite, readErr)
+	}
+
+	var u User
+	if err := db.Read("users", "Eren", &u); err != nil || u.Age != "20" {
+		t.Errorf("Read after write = %+v, %v, want Age 20", u, err)
+	}
+}
+
+// fullStorage hands writes files that run out of space half way through.
+type fullStorage struct {
+	osStorage
+}
+
+type fullFile struct {
+	*os.File
+}
+
+func (s fullStorage) OpenFile(name string, flag int, perm os.FileMode) (writableFile, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	return fullFile{f}, err
+}
+
+func (f fullFile) Write(b []byte) (int, error) {
+	n, _ := f.File.Write(b[:len(b)/2])
+	return n, &os.PathError{Op: "write", Path: f.Name(), Err: syscall.ENOSPC}
+}
+
+func TestWriteDiskFull(t *testing.T) {
+	db := newTestDriver(t, nil)
+	if err := db.Write("users", "Eren", User{Name: "Eren", Age: "19"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	db.storage = fullStorage{}
+	err := db.Write("users", "Eren", User{Name: "Eren", Age: "20"})
+	if !errors.Is(err, ErrDiskFull) {
+		t.Fatalf("Write on a full disk = %v, want ErrDiskFull", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(db.Dir(), "users", "Eren.json.tmp")); !os.IsNotExist(err) {
+		t.Errorf("partial temp file was left behind: %v", err)
+	}
+	var u User
+	if err := db.Read("users", "Eren", &u); err != nil || u.Age != "19" {
+		t.Errorf("Read after failed write = %+v, %v, want the prior record", u, err)
+	}
+}
+
+func benchmarkRecords(n int) map[string]interface{} {
+	records := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("user%04d", i)
+		records[name] = User{Name: name, Company: "cedar"}
+	}
+	return records
+}
+
+func BenchmarkDurableWritePerFile(b *testing.B) {
+	db := newTestDriver(b, &Options{Durable: true})
+	records := benchmarkRecords(200)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for resource, v := range records {
+			if err := db.Write("users", resource, v); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkDurableWriteBatch(b *testing.B) {
+	db := newTestDriver(b, &Options{Durable: true})
+	records := benchmarkRecords(200)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := db.WriteBatch("users", records); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWrite(b *testing.B) {
+	db := newTestDriver(b, nil)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := db.Write("users", "Eren", User{Name: "Eren"}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkCollectionLocks(b *testing.B, options *Options) {
+	db := newTestDriver(b, options)
+	collections := make([]string, 10000)
+	for i := range collections {
+		collections[i] = fmt.Sprintf("c%d", i)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			m := db.getOrCreateMutex(collections[i%len(collections)])
+			m.Lock()
+			m.Unlock()
+		}
+	})
+}
+
+func BenchmarkCollectionLocksMap(b *testing.B) {
+	benchmarkCollectionLocks(b, nil)
+}
+
+func BenchmarkCollectionLocksStriped(b *testing.B) {
+	benchmarkCollectionLocks(b, &Options{MutexStripes: 256})
+}
+
+func TestMaxOpenCollections(t *testing.T) {
+	db := newTestDriver(t, &Options{MaxOpenCollections: 4})
+
+	held := db.lockCollection("held")
+	for i := 0; i < 50; i++ {
+		if err := db.Write(fmt.Sprintf("c%d", i), "r", i); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	db.mutex.Lock()
+	open, kept := len(db.mutexes), db.mutexes["held"] == held
+	db.mutex.Unlock()
+	if open > 4 {
+		t.Errorf("Driver kept %d collection mutexes, want at most 4", open)
+	}
+	if !kept {
+		t.Error("a held collection mutex was evicted")
+	}
+	held.Unlock()
+
+	// Evicting and recreating mutexes must never let two goroutines hold
+	// the same collection's lock.
+	var wg sync.WaitGroup
+	var inUse [10]int32
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				n := (g + i) % len(inUse)
+				m := db.lockCollection(fmt.Sprintf("c%d", n))
+				if atomic.AddInt32(&inUse[n], 1) != 1 {
+					t.Errorf("c%d locked twice at once", n)
+				}
+				atomic.AddInt32(&inUse[n], -1)
+				m.Unlock()
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestMutexStripes(t *testing.T) {
+	db := newTestDriver(t, &Options{MutexStripes: 4})
+
+	for i := 0; i < 20; i++ {
+		if err := db.Write(fmt.Sprintf("c%d", i), "r", i); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if db.getOrCreateMutex("c1") != db.getOrCreateMutex("c1") {
+		t.Error("a collection doesn't always map to the same stripe")
+	}
+	if len(db.mutexes) != 0 {
+		t.Errorf("striped Driver kept %d per-collection mutexes", len(db.mutexes))
+	}
+
+	counts, err := db.CollectionCounts()
+	if err != nil || len(counts) != 20 {
+		t.Errorf("CollectionCounts = %v, %v", counts, err)
+	}
+	if _, err := db.Digest(); err != nil {
+		t.Errorf("Digest under striped locks: %v", err)
+	}
+}
+
+func TestDirIsCleaned(t *testing.T) {
+	root := t.TempDir()
+
+	db, err := New(root+"/a/../db/", nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	if want := filepath.Join(root, "db"); db.Dir() != want {
+		t.Errorf("Dir() = %q, want %q", db.Dir(), want)
+	}
+}
+
+func TestFieldMap(t *testing.T) {
+	db := newTestDriver(t, nil)
+	db.SetFieldMap("users", map[string]string{"Name": "n", "Company": "c"})
+
+	if err := db.Write("users", "Eren", User{Name: "Eren", Company: "Domini"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(db.Dir(), "users", "Eren.json"))
+	if err != nil {
+		t.Fatalf("reading record file: %v", err)
+	}
+	var onDisk map[string]interface{}
+	if err := json.Unmarshal(b, &onDisk); err != nil {
+		t.Fatalf("record file is not JSON: %v", err)
+	}
+	if onDisk["n"] != "Eren" || onDisk["c"] != "Domini" {
+		t.Errorf("on-disk record %s doesn't use the short keys", b)
+	}
+	if _, ok := onDisk["Name"]; ok {
+		t.Errorf("on-disk record %s still holds the long key Name", b)
+	}
+
+	var u User
+	if err := db.Read("users", "Eren", &u); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if u.Name != "Eren" || u.Company != "Domini" {
+		t.Errorf("Read = %+v, want the long field names restored", u)
+	}
+
+	records, err := db.ReadAll("users")
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if len(records) != 1 || !strings.Contains(records[0], `"Name"`) {
+		t.Errorf("ReadAll = %q, want the long field names restored", records)
+	}
+}
+
+func TestCollectionCounts(t *testing.T) {
+	db := newTestDriver(t, &Options{ChangeLog: true})
+
+	writes := map[string][]string{
+		"users":  {"Eren", "Mikasa", "_draft"},
+		"orders": {"1"},
+	}
+	for collection, resources := range writes {
+		for _, resource := range resources {
+			if err := db.Write(collection, resource, User{Name: resource}); err != nil {
+				t.Fatalf("Write %s/%s: %v", collection, resource, err)
+			}
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(db.Dir(), "users", "Levi.json.tmp"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(db.Dir(), "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	counts, err := db.CollectionCounts()
+	if err != nil {
+		t.Fatalf("CollectionCounts: %v", err)
+	}
+
+	want := map[string]int{"users": 3, "orders": 1, "empty": 0}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("CollectionCounts() = %v, want %v", counts, want)
+	}
+}
+
+func TestKeySizes(t *testing.T) {
+	db := newTestDriver(t, nil)
+	writeEmployees(t, db)
+	if err := ioutil.WriteFile(filepath.Join(db.Dir(), "users", "Levi.json.tmp"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sizes, err := db.KeySizes("users")
+	if err != nil {
+		t.Fatalf("KeySizes: %v", err)
+	}
+	if len(sizes) != 6 {
+		t.Errorf("KeySizes = %v, want the 6 users", sizes)
+	}
+	for resource, size := range sizes {
+		fi, err := os.Stat(filepath.Join(db.Dir(), "users", resource+".json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != fi.Size() {
+			t.Errorf("%s size = %d, want %d", resource, size, fi.Size())
+		}
+	}
+}
+
+func TestCollectionsBySize(t *testing.T) {
+	db := newTestDriver(t, nil)
+
+	sizes := map[string]int{"small": 1, "large": 5, "medium": 3}
+	for collection, n := range sizes {
+		for i := 0; i < n; i++ {
+			name := fmt.Sprintf("user%d", i)
+			if err := db.Write(collection, name, User{Name: name, Contact: strings.Repeat("x", 100)}); err != nil {
+				t.Fatalf("Write %s/%s: %v", collection, name, err)
+			}
+		}
+	}
+
+	stats, err := db.CollectionsBySize()
+	if err != nil {
+		t.Fatalf("CollectionsBySize: %v", err)
+	}
+
+	var names []string
+	for i, stat := range stats {
+		names = append(names, stat.Name)
+		if stat.Records != sizes[stat.Name] {
+			t.Errorf("%s Records = %d, want %d", stat.Name, stat.Records, sizes[stat.Name])
+		}
+		if i > 0 && stat.Bytes >= stats[i-1].Bytes {
+			t.Errorf("%s has %d bytes, not fewer than %s's %d", stat.Name, stat.Bytes, stats[i-1].Name, stats[i-1].Bytes)
+		}
+	}
+	if want := []string{"large", "medium", "small"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("order = %v, want %v", names, want)
+	}
+}
+
+func TestAppendConcurrent(t *testing.T) {
+	db := newTestDriver(t, nil)
+
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := db.Append("logs", "events", i); err != nil {
+				t.Errorf("Append %d: %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var items []int
+	if err := db.Read("logs", "events", &items); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	sort.Ints(items)
+	if len(items) != n {
+		t.Fatalf("got %d items, want %d", len(items), n)
+	}
+	for i, v := range items {
+		if v != i {
+			t.Fatalf("items = %v, want 0..%d", items, n-1)
+		}
+	}
+}
+
+func TestAppendRejectsNonArray(t *testing.T) {
+	db := newTestDriver(t, nil)
+
+	if err := db.Write("users", "Eren", User{Name: "Eren"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := db.Append("users", "Eren", 1); err == nil {
+		t.Error("Append to an object record succeeded")
+	}
+}
+
+func TestPopFIFO(t *testing.T) {
+	db := newTestDriver(t, nil)
+
+	if _, err := db.Pop("queue", "jobs"); !errors.Is(err, ErrEmpty) {
+		t.Fatalf("Pop on missing record = %v, want ErrEmpty", err)
+	}
+
+	const n = 40
+	for i := 0; i < n; i++ {
+		if err := db.Append("queue", "jobs", i); err != nil {
+			t.Fatalf("Append %d: %v", i, err)
+		}
+	}
+
+	var mutex sync.Mutex
+	var popped []int
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			last := -1
+			for {
+				raw, err := db.Pop("queue", "jobs")
+				if errors.Is(err, ErrEmpty) {
+					return
+				}
+				if err != nil {
+					t.Errorf("Pop: %v", err)
+					return
+				}
+
+				var v int
+				if err := json.Unmarshal(raw, &v); err != nil {
+					t.Errorf("popped %s: %v", raw, err)
+					return
+				}
+				if v <= last {
+					t.Errorf("popped %d after %d, want FIFO order", v, last)
+				}
+				last = v
+
+				mutex.Lock()
+				popped = append(popped, v)
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	sort.Ints(popped)
+	if len(popped) != n {
+		t.Fatalf("popped %d items, want %d", len(popped), n)
+	}
+	for i, v := range popped {
+		if v != i {
+			t.Fatalf("popped %v, want each of 0..%d once", popped, n-1)
+		}
+	}
+}
+
+// writeEmployees stores the example dataset from main in the users
+// collection.
+func writeEmployees(t testing.TB, db *Driver) {
+	t.Helper()
+
+	employees := []User{
+		{"Mikasa", "23", "3456532456", "cedar", Address{"Bangalore", "ktaka", "india", "7654"}},
+		{"Johan", "27", "3456532456", "Google", Address{"NYC", "NY", "USA", "356"}},
+		{"Maximilian", "28", "3456532456", "Microsoft", Address{"Paris", "", "France", "9875"}},
+		{"Reiner", "34", "3456532456", "Remote", Address{"Prague", "", "Czech Republic", "6568"}},
+		{"Eren", "29", "3456532456", "Domini", Address{"Dubai", "", "Abu Dhabi", "899"}},
+		{"Erwin", "33", "3456532456", "Fidelity", Address{"Pune", "Maha", "india", "432123"}},
+	}
+
+	for _, u := range employees {
+		if err := db.Write("users", u.Name, u); err != nil {
+			t.Fatalf("Write %s: %v", u.Name, err)
+		}
+	}
+}
+
+func TestTransform(t *testing.T) {
+	rejected := errors.New("no company")
+	db := newTestDriver(t, &Options{
+		Transform: func(collection, resource string, v interface{}) (interface{}, error) {
+			u, ok := v.(User)
+			if !ok {
+				return v, nil
+			}
+			if u.Company == "" {
+				return nil, rejected
+			}
+			u.Name = strings.TrimSpace(u.Name)
+			return u, nil
+		},
+	})
+
+	if err := db.Write("users", "Eren", User{Name: "  Eren \t", Company: "Domini"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	var u User
+	if err := db.Read("users", "Eren", &u); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if u.Name != "Eren" {
+		t.Errorf("stored Name = %q, want the trimmed Eren", u.Name)
+	}
+
+	if err := db.Write("users", "Levi", User{Name: "Levi"}); !errors.Is(err, rejected) {
+		t.Errorf("Write = %v, want the transform's error", err)
+	}
+	if err := db.Read("users", "Levi", &u); err == nil {
+		t.Error("rejected record was written")
+	}
+}
+
+func TestFindDuplicates(t *testing.T) {
+	db := newTestDriver(t, nil)
+
+	for resource, u := range map[string]User{
+		"a": {Name: "Eren"},
+		"b": {Name: "Eren"},
+		"c": {Name: "Mikasa"},
+	} {
+		if err := db.Write("users", resource, u); err != nil {
+			t.Fatalf("Write %s: %v", resource, err)
+		}
+	}
+
+	groups, err := db.FindDuplicates("users")
+	if err != nil {
+		t.Fatalf("FindDuplicates: %v", err)
+	}
+	if len(groups) != 1 {
+		t.Fatalf("FindDuplicates = %v, want one group", groups)
+	}
+
+	sum, err := db.RecordHash("users", "a")
+	if err != nil {
+		t.Fatalf("RecordHash: %v", err)
+	}
+	if got := groups[sum]; !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("group %s = %v, want [a b]", sum, got)
+	}
+}
+
+// slowStorage delays every read, standing in for a slow filesystem.
+type slowStorage struct {
+	delay time.Duration
+}
+
+func (s slowStorage) ReadFile(name string) ([]byte, error) {
+	time.Sleep(s.delay)
+	return osStorage{}.ReadFile(name)
+}
+
+func TestReadAllPartial(t *testing.T) {
+	db := newTestDriver(t, nil)
+	for i := 0; i < 20; i++ {
+		if err := db.Write("users", fmt.Sprintf("user%02d", i), User{Name: "x"}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	records, complete, err := db.ReadAllPartial(context.Background(), "users")
+	if err != nil || !complete || len(records) != 20 {
+		t.Fatalf("ReadAllPartial without deadline = %d records, complete %v, err %v", len(records), complete, err)
+	}
+
+	db.storage = slowStorage{delay: 20 * time.Millisecond}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 70*time.Millisecond)
+	defer cancel()
+
+	records, complete, err = db.ReadAllPartial(ctx, "users")
+	if err != nil {
+		t.Fatalf("ReadAllPartial: %v", err)
+	}
+	if complete {
+		t.Error("complete = true, want false after the deadline")
+	}
+	if len(records) == 0 || len(records) >= 20 {
+		t.Errorf("got %d records, want a partial result", len(records))
+	}
+}
+
+// recordingLogger keeps the warnings logged through it.
+type recordingLogger struct {
+	mutex sync.Mutex
+	warns []string
+}
+
+func (l *recordingLogger) Fatal(string, ...interface{}) {}
+func (l *recordingLogger) Error(string, ...interface{}) {}
+func (l *recordingLogger) Info(string, ...interface{})  {}
+func (l *recordingLogger) Debug(string, ...interface{}) {}
+func (l *recordingLogger) Trace(string, ...interface{}) {}
+
+func (l *recordingLogger) Warn(format string, v ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.warns = append(l.warns, fmt.Sprintf(format, v...))
+}
+
+func (l *recordingLogger) warnings() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return append([]string(nil), l.warns...)
+}
+
+func TestStaleAfterWarns(t *testing.T) {
+	logger := &recordingLogger{}
+	db := newTestDriver(t, &Options{Logger: logger, StaleAfter: time.Hour})
+
+	for _, name := range []string{"Eren", "Mikasa"} {
+		if err := db.Write("users", name, User{Name: name}); err != nil {
+			t.Fatalf("Write %s: %v", name, err)
+		}
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(filepath.Join(db.Dir(), "users", "Eren.json"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	var u User
+	if err := db.Read("users", "Mikasa", &u); err != nil {
+		t.Fatalf("Read Mikasa: %v", err)
+	}
+	if w := logger.warnings(); len(w) != 0 {
+		t.Errorf("fresh read logged %q", w)
+	}
+
+	if err := db.Read("users", "Eren", &u); err != nil {
+		t.Fatalf("Read Eren: %v", err)
+	}
+	if u.Name != "Eren" {
+		t.Errorf("Name = %q, want Eren", u.Name)
+	}
+	w := logger.warnings()
+	if len(w) != 1 || !strings.Contains(w[0], "users/Eren") {
+		t.Errorf("warnings = %q, want one naming users/Eren", w)
+	}
+}
+
+// blockingStorage stalls every read until release is closed, standing in
+// for a stuck filesystem.
+type blockingStorage struct {
+	release chan struct{}
+}
+
+func (s blockingStorage) ReadFile(name string) ([]byte, error) {
+	<-s.release
+	return osStorage{}.ReadFile(name)
+}
+
+func TestOperationTimeoutOnBlockedStorage(t *testing.T) {
+	db := newTestDriver(t, &Options{OperationTimeout: 20 * time.Millisecond})
+	if err := db.Write("users", "Eren", User{Name: "Eren"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	release := make(chan struct{})
+	defer close(release)
+	db.storage = blockingStorage{release: release}
+
+	var u User
+	reads := map[string]func() error{
+		"Read": func() error { return db.Read("users", "Eren", &u) },
+		"ReadFallback": func() error {
+			return db.ReadFallback("Eren", []string{"admins", "users"}, &u)
+		},
+		"ReadWithHash": func() error {
+			_, err := db.ReadWithHash("users", "Eren", &u)
+			return err
+		},
+		"RecordHash": func() error {
+			_, err := db.RecordHash("users", "Eren")
+			return err
+		},
+		"ReadAll": func() error {
+			_, err := db.ReadAll("users")
+			return err
+		},
+	}
+	for name, read := range reads {
+		if err := read(); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s = %v, want context.DeadlineExceeded", name, err)
+		}
+	}
+}
+
+func TestOperationTimeoutOnHeldLock(t *testing.T) {
+	db := newTestDriver(t, &Options{OperationTimeout: 20 * time.Millisecond})
+	if err := db.Write("users", "Eren", User{Name: "Eren"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	mutex := db.getOrCreateMutex("users")
+	mutex.Lock()
+	defer mutex.Unlock()
+	// The timed out operations resume once the lock is released; keep
+	// them from writing into the directory while it is being removed.
+	defer db.SetReadOnly(true)
+
+	writes := map[string]func() error{
+		"Write": func() error { return db.Write("users", "Eren", User{Name: "Eren"}) },
+		"WriteBatch": func() error {
+			return db.WriteBatch("users", map[string]interface{}{"Eren": User{Name: "Eren"}})
+		},
+		"Append": func() error { return db.Append("users", "log", 1) },
+		"Pop": func() error {
+			_, err := db.Pop("users", "log")
+			return err
+		},
+		"Delete": func() error { return db.Delete("users", "Eren") },
+	}
+	for name, write := range writes {
+		if err := write(); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s = %v, want context.DeadlineExceeded", name, err)
+		}
+	}
+}
+
+func TestKeysByModTime(t *testing.T) {
+	db := newTestDriver(t, nil)
+
+	base := time.Now().Add(-time.Hour)
+	for resource, offset := range map[string]time.Duration{
+		"c": 0,
+		"a": time.Minute,
+		"b": time.Minute,
+		"d": 2 * time.Minute,
+	} {
+		if err := db.Write("users", resource, User{Name: resource}); err != nil {
+			t.Fatalf("Write %s: %v", resource, err)
+		}
+		mtime := base.Add(offset)
+		if err := os.Chtimes(filepath.Join(db.Dir(), "users", resource+".json"), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, err := db.KeysByModTime("users", false)
+	if err != nil {
+		t.Fatalf("KeysByModTime: %v", err)
+	}
+	if want := []string{"c", "a", "b", "d"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("ascending = %v, want %v", keys, want)
+	}
+
+	keys, err = db.KeysByModTime("users", true)
+	if err != nil {
+		t.Fatalf("KeysByModTime: %v", err)
+	}
+	if want := []string{"d", "a", "b", "c"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("descending = %v, want %v", keys, want)
+	}
+}
+
+func TestDigest(t *testing.T) {
+	a := newTestDriver(t, nil)
+	b := newTestDriver(t, nil)
+	writeEmployees(t, a)
+	writeEmployees(t, b)
+	if err := ioutil.WriteFile(filepath.Join(b.Dir(), "users", "Levi.json.tmp"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	digest := func(db *Driver) string {
+		t.Helper()
+		sum, err := db.Digest()
+		if err != nil {
+			t.Fatalf("Digest: %v", err)
+		}
+		return sum
+	}
+
+	if digest(a) != digest(b) {
+		t.Error("identical databases have different digests")
+	}
+
+	if err := b.Write("users", "Eren", User{Name: "Eren", Age: "30"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if digest(a) == digest(b) {
+		t.Error("changing a record left the digest unchanged")
+	}
+}
+
+func TestDigestDuringWrites(t *testing.T) {
+	db := newTestDriver(t, nil)
+	writeEmployees(t, db)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			db.Write("users", "Eren", User{Name: "Eren", Age: json.Number(fmt.Sprint(i))})
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		if _, err := db.Digest(); err != nil {
+			t.Errorf("Digest: %v", err)
+		}
+	}
+	<-done
+}
+
+func TestRelocate(t *testing.T) {
+	db := newTestDriver(t, nil)
+	writeEmployees(t, db)
+	oldDir := db.Dir()
+
+	newDir := filepath.Join(t.TempDir(), "bigger", "disk")
+	if err := db.Relocate(newDir); err != nil {
+		t.Fatalf("Relocate: %v", err)
+	}
+
+	if db.Dir() != newDir {
+		t.Errorf("Dir() = %q, want %q", db.Dir(), newDir)
+	}
+	if _, err := os.Stat(oldDir); !os.IsNotExist(err) {
+		t.Errorf("old directory still exists: %v", err)
+	}
+
+	var u User
+	if err := db.Read("users", "Eren", &u); err != nil || u.Name != "Eren" {
+		t.Errorf("Read after Relocate = %+v, %v", u, err)
+	}
+	if err := db.Write("users", "Levi", User{Name: "Levi"}); err != nil {
+		t.Fatalf("Write after Relocate: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(newDir, "users", "Levi.json")); err != nil {
+		t.Errorf("write after Relocate didn't land in the new directory: %v", err)
+	}
+
+	if err := db.Relocate(t.TempDir()); err == nil {
+		t.Error("Relocate onto an existing directory succeeded")
+	}
+}
+
+func TestCopyTree(t *testing.T) {
+	src := newTestDriver(t, nil)
+	writeEmployees(t, src)
+
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	record := filepath.Join(src.Dir(), "users", "Eren.json")
+	if err := os.Chtimes(record, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	dstDir := filepath.Join(t.TempDir(), "copy")
+	if err := copyTree(src.Dir(), dstDir); err != nil {
+		t.Fatalf("copyTree: %v", err)
+	}
+
+	dst, err := New(dstDir, nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	want, _ := src.Digest()
+	if got, _ := dst.Digest(); got != want {
+		t.Error("copied tree differs from the original")
+	}
+
+	fi, err := os.Stat(filepath.Join(dstDir, "users", "Eren.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(mtime) {
+		t.Errorf("copied mtime = %v, want %v", fi.ModTime(), mtime)
+	}
+}
+
+func TestCompressOverBytes(t *testing.T) {
+	db := newTestDriver(t, &Options{CompressOverBytes: 256})
+
+	small := User{Name: "Eren"}
+	large := User{Name: "Reiner", Company: strings.Repeat("Remote ", 200)}
+	for resource, u := range map[string]User{"small": small, "large": large} {
+		if err := db.Write("users", resource, u); err != nil {
+			t.Fatalf("Write %s: %v", resource, err)
+		}
+	}
+
+	smallBytes, err := ioutil.ReadFile(filepath.Join(db.Dir(), "users", "small.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !json.Valid(smallBytes) {
+		t.Errorf("small record was not stored as plain JSON: %q", smallBytes)
+	}
+	if _, err := os.Stat(filepath.Join(db.Dir(), "users", "small.json.gz")); !os.IsNotExist(err) {
+		t.Errorf("small record has a compressed file: %v", err)
+	}
+	largeBytes, err := ioutil.ReadFile(filepath.Join(db.Dir(), "users", "large.json.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if json.Valid(largeBytes) || len(largeBytes) >= len(large.Company) {
+		t.Errorf("large record was not compressed (%d bytes on disk)", len(largeBytes))
+	}
+
+	for resource, want := range map[string]User{"small": small, "large": large} {
+		var got User
+		if err := db.Read("users", resource, &got); err != nil {
+			t.Fatalf("Read %s: %v", resource, err)
+		}
+		if got.Name != want.Name || got.Company != want.Company {
+			t.Errorf("Read %s = %.60v, want %.60v", resource, got, want)
+		}
+	}
+
+	records, err := db.ReadAll("users")
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	for _, r := range records {
+		if !json.Valid([]byte(r)) {
+			t.Errorf("ReadAll returned a record that isn't JSON: %.40q", r)
+		}
+	}
+
+	if err := db.Write("users", "large", small); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(db.Dir(), "users", "large.json.gz")); !os.IsNotExist(err) {
+		t.Errorf("compressed file left behind after the record shrank: %v", err)
+	}
+	if n, _ := db.EstimateCount("users"); n != 2 {
+		t.Errorf("EstimateCount = %d, want 2", n)
+	}
+
+	if err := db.Delete("users", "small"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := db.Write("users", "large", large); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := db.Delete("users", "large"); err != nil {
+		t.Fatalf("Delete of a compressed record: %v", err)
+	}
+	if files, _ := os.ReadDir(filepath.Join(db.Dir(), "users")); len(files) != 0 {
+		t.Errorf("files left after deleting every record: %v", files)
+	}
+}
+
+func TestOrphanedFiles(t *testing.T) {
+	db := newTestDriver(t, nil)
+	writeEmployees(t, db)
+	if err := db.Write("orders", "1", []int{1}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	planted := []string{
+		filepath.Join(db.Dir(), "orders", "2.json.tmp"),
+		filepath.Join(db.Dir(), "users", "Eren.json.tmp"),
+		filepath.Join(db.Dir(), "users", "notes.txt"),
+	}
+	for _, path := range planted {
+		if err := ioutil.WriteFile(path, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	orphans, err := db.OrphanedFiles()
+	if err != nil {
+		t.Fatalf("OrphanedFiles: %v", err)
+	}
+	if !reflect.DeepEqual(orphans, planted) {
+		t.Errorf("OrphanedFiles() = %v, want %v", orphans, planted)
+	}
+
+	for _, path := range planted {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s was removed: %v", path, err)
+		}
+	}
+}
+
+func TestSetReadOnly(t *testing.T) {
+	db := newTestDriver(t, nil)
+	if err := db.Write("users", "Eren", User{Name: "Eren"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	db.SetReadOnly(true)
+
+	writes := map[string]func() error{
+		"Write":    func() error { return db.Write("users", "Levi", User{Name: "Levi"}) },
+		"Append":   func() error { return db.Append("logs", "events", 1) },
+		"Delete":   func() error { return db.Delete("users", "Eren") },
+		"Relocate": func() error { return db.Relocate(filepath.Join(t.TempDir(), "moved")) },
+		"WriteStream": func() error {
+			_, err := db.WriteStream("users", "Levi")
+			return err
+		},
+	}
+	for name, write := range writes {
+		if err := write(); !errors.Is(err, ErrReadOnly) {
+			t.Errorf("%s in read-only mode = %v, want ErrReadOnly", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(db.Dir(), "logs")); !os.IsNotExist(err) {
+		t.Errorf("read-only Append created a collection: %v", err)
+	}
+
+	var u User
+	if err := db.Read("users", "Eren", &u); err != nil {
+		t.Errorf("Read in read-only mode: %v", err)
+	}
+	if _, err := db.ReadAll("users"); err != nil {
+		t.Errorf("ReadAll in read-only mode: %v", err)
+	}
+
+	db.SetReadOnly(false)
+	if err := db.Write("users", "Levi", User{Name: "Levi"}); err != nil {
+		t.Errorf("Write after leaving read-only mode: %v", err)
+	}
+	if err := db.Delete("users", "Eren"); err != nil {
+		t.Errorf("Delete after leaving read-only mode: %v", err)
+	}
+}
+
+func TestEstimateCount(t *testing.T) {
+	db := newTestDriver(t, nil)
+	writeEmployees(t, db)
+	if err := os.Mkdir(filepath.Join(db.Dir(), "users", "archive.json"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(db.Dir(), "users", "Levi.json.tmp"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	counts, err := db.CollectionCounts()
+	if err != nil {
+		t.Fatalf("CollectionCounts: %v", err)
+	}
+	n, err := db.EstimateCount("users")
+	if err != nil {
+		t.Fatalf("EstimateCount: %v", err)
+	}
+	if n != counts["users"] || n != 6 {
+		t.Errorf("EstimateCount = %d, want the exact count %d", n, counts["users"])
+	}
+
+	if _, err := db.EstimateCount("missing"); err == nil {
+		t.Error("EstimateCount on a missing collection succeeded")
+	}
+}
+
+func TestReadWithHash(t *testing.T) {
+	db := newTestDriver(t, &Options{CacheSize: 4})
+	if err := db.Write("users", "Eren", User{Name: "Eren"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	var u User
+	hash, err := db.ReadWithHash("users", "Eren", &u)
+	if err != nil {
+		t.Fatalf("ReadWithHash: %v", err)
+	}
+	if u.Name != "Eren" {
+		t.Errorf("Name = %q, want Eren", u.Name)
+	}
+
+	again, err := db.RecordHash("users", "Eren")
+	if err != nil {
+		t.Fatalf("RecordHash: %v", err)
+	}
+	if hash != again {
+		t.Errorf("ReadWithHash hash %s != RecordHash %s", hash, again)
+	}
+
+	if err := db.Write("users", "Eren", User{Name: "Eren", Age: "30"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if changed, _ := db.RecordHash("users", "Eren"); changed == hash {
+		t.Error("RecordHash unchanged after the record was rewritten")
+	}
+}
+
+func TestCanonicalJSON(t *testing.T) {
+	db := newTestDriver(t, &Options{CanonicalJSON: true})
+
+	record := func() map[string]interface{} {
+		return map[string]interface{}{
+			"zeta":  1.5,
+			"alpha": map[string]interface{}{"y": []interface{}{3, "b"}, "x": true},
+			"big":   json.Number("12345678901234567890"),
+		}
+	}
+
+	read := func() []byte {
+		t.Helper()
+		b, err := ioutil.ReadFile(filepath.Join(db.Dir(), "maps", "m.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	if err := db.Write("maps", "m", record()); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	first := read()
+	if err := db.Write("maps", "m", record()); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if second := read(); !bytes.Equal(first, second) {
+		t.Errorf("second write differs:\n%s\n%s", first, second)
+	}
+
+	type reordered struct {
+		Zeta  float64     `json:"zeta"`
+		Big   json.Number `json:"big"`
+		Alpha struct {
+			X bool          `json:"x"`
+			Y []interface{} `json:"y"`
+		} `json:"alpha"`
+	}
+	var v reordered
+	v.Zeta, v.Big, v.Alpha.X, v.Alpha.Y = 1.5, "12345678901234567890", true, []interface{}{3, "b"}
+	if err := db.Write("maps", "m", v); err != nil {
+		t.Fatalf("Write struct: %v", err)
+	}
+	if fromStruct := read(); !bytes.Equal(first, fromStruct) {
+		t.Errorf("struct with differently ordered fields encodes differently:\n%s\n%s", first, fromStruct)
+	}
+}
+
+func TestWithExclusive(t *testing.T) {
+	db := newTestDriver(t, nil)
+	writeEmployees(t, db)
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	exclusive := make(chan error)
+	go func() {
+		exclusive <- db.WithExclusive(func() error {
+			close(entered)
+			<-release
+			return nil
+		})
+	}()
+	<-entered
+
+	done := make(chan string, 2)
+	go func() {
+		db.Write("users", "Eren", User{Name: "Eren", Age: "30"})
+		done <- "existing collection"
+	}()
+	go func() {
+		db.Write("orders", "1", []int{1})
+		done <- "new collection"
+	}()
+
+	select {
+	case which := <-done:
+		t.Fatalf("write to a %s finished during the exclusive section", which)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-exclusive; err != nil {
+		t.Fatalf("WithExclusive: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("writes didn't resume after the exclusive section")
+		}
+	}
+}
+
+func TestWithExclusiveWithQueriesOnNewCollections(t *testing.T) {
+	db := newTestDriver(t, nil)
+	// Plenty of existing collections keep each WithExclusive busy locking
+	// them while new ones are created.
+	for i := 0; i < 100; i++ {
+		if err := db.Write(fmt.Sprintf("m%03d", i), "1", []int{1}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				db.WithExclusive(func() error { return nil })
+			}
+		}()
+		for g := 0; g < 4; g++ {
+			// Writers contending for m099 slow down whoever locks it.
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 200; i++ {
+					db.Write("m099", "1", []int{i})
+				}
+			}()
+		}
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					// Each new collection sorts before m099, which
+					// WithExclusive may already hold.
+					collection := fmt.Sprintf("a%d-%d", g, i)
+					db.Query([]string{collection, "m099"}, func(q *QueryContext) (interface{}, error) {
+						return nil, nil
+					})
+				}
+			}(g)
+		}
+		wg.Wait()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("WithExclusive deadlocked with queries on new collections")
+	}
+}
+
+func TestReadFallback(t *testing.T) {
+	db := newTestDriver(t, nil)
+
+	if err := db.Write("defaults", "theme", map[string]string{"color": "grey"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := db.Write("defaults", "font", map[string]string{"family": "serif"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := db.Write("tenant", "theme", map[string]string{"color": "red"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	chain := []string{"tenant", "defaults"}
+	for resource, want := range map[string]map[string]string{
+		"theme": {"color": "red"},
+		"font":  {"family": "serif"},
+	} {
+		var got map[string]string
+		if err := db.ReadFallback(resource, chain, &got); err != nil {
+			t.Fatalf("ReadFallback %s: %v", resource, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ReadFallback %s = %v, want %v", resource, got, want)
+		}
+	}
+
+	var v map[string]string
+	if err := db.ReadFallback("missing", chain, &v); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("ReadFallback of a missing record = %v, want ErrRecordNotFound", err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(db.Dir(), "theme.json"), []byte(`{"color": "root"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ReadFallback("theme", []string{"", "defaults"}, &v); err == nil {
+		t.Errorf("ReadFallback accepted an empty collection and read %v", v)
+	}
+}
+
+// countingStorage records how many reads are in flight at once, and how
+// many there were in all.
+type countingStorage struct {
+	mutex    sync.Mutex
+	open     int
+	maxOpen  int
+	reads    int
+	duration time.Duration
+}
+
+func (s *countingStorage) ReadFile(name string) ([]byte, error) {
+	s.mutex.Lock()
+	s.reads++
+	s.open++
+	if s.open > s.maxOpen {
+		s.maxOpen = s.open
+	}
+	s.mutex.Unlock()
+
+	time.Sleep(s.duration)
+	b, err := osStorage{}.ReadFile(name)
+
+	s.mutex.Lock()
+	s.open--
+	s.mutex.Unlock()
+
+	return b, err
+}
+
+func TestMaxConcurrentFiles(t *testing.T) {
+	db := newTestDriver(t, &Options{MaxConcurrentFiles: 2})
+	writeEmployees(t, db)
+
+	storage := &countingStorage{duration: time.Millisecond}
+	db.storage = storage
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			var err error
+			switch i % 3 {
+			case 0:
+				var u User
+				err = db.Read("users", "Eren", &u)
+			case 1:
+				_, err = db.ReadAll("users")
+			case 2:
+				_, err = ReadAllTyped[User](db, "users")
+			}
+			if err != nil {
+				t.Errorf("read %d: %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if storage.maxOpen > 2 {
+		t.Errorf("%d files were open at once, want at most 2", storage.maxOpen)
+	}
+	if len(db.files) != 0 {
+		t.Errorf("%d file slots still held after every read finished", len(db.files))
+	}
+
+	var buf bytes.Buffer
+	if err := db.ExportZip(&buf); err != nil {
+		t.Fatalf("ExportZip: %v", err)
+	}
+	if _, err := db.FindDuplicates("users"); err != nil {
+		t.Fatalf("FindDuplicates: %v", err)
+	}
+	if len(db.files) != 0 {
+		t.Errorf("%d file slots still held after streaming reads", len(db.files))
+	}
+}
+
+func TestReplaceCollection(t *testing.T) {
+	db := newTestDriver(t, &Options{CacheSize: 16})
+
+	set := func(prefix string, n int) map[string]interface{} {
+		records := make(map[string]interface{}, n)
+		for i := 0; i < n; i++ {
+			records[fmt.Sprintf("%s%d", prefix, i)] = User{Name: prefix}
+		}
+		return records
+	}
+	if err := db.ReplaceCollection("users", set("old", 5)); err != nil {
+		t.Fatalf("ReplaceCollection: %v", err)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				records, err := db.ReadAll("users")
+				if err != nil {
+					t.Errorf("ReadAll: %v", err)
+					return
+				}
+				olds := 0
+				for _, r := range records {
+					if strings.Contains(r, `"old"`) {
+						olds++
+					}
+				}
+				if !(olds == 5 && len(records) == 5) && !(olds == 0 && len(records) == 3) {
+					t.Errorf("ReadAll saw %d records, %d of them old: a mix of both sets", len(records), olds)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		next := set("new", 3)
+		if i%2 == 1 {
+			next = set("old", 5)
+		}
+		if err := db.ReplaceCollection("users", next); err != nil {
+			t.Fatalf("ReplaceCollection: %v", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	var u User
+	if err := db.Read("users", "old4", &u); err != nil || u.Name != "old" {
+		t.Errorf("Read after the last replace = %+v, %v", u, err)
+	}
+	if err := db.Read("users", "new0", &u); err == nil {
+		t.Error("record from an earlier set survived the replace")
+	}
+
+	collections, err := db.collections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(collections, []string{"users"}) {
+		t.Errorf("collections = %v, want only users", collections)
+	}
+}
+
+func TestReplaceCollectionKeepsOldSetOnFailure(t *testing.T) {
+	db := newTestDriver(t, nil)
+	writeEmployees(t, db)
+	if err := db.SetUnique("users", "Name"); err != nil {
+		t.Fatalf("SetUnique: %v", err)
+	}
+
+	err := db.ReplaceCollection("users", map[string]interface{}{
+		"a": User{Name: "Levi"},
+		"b": User{Name: "Levi"},
+	})
+	if !errors.Is(err, ErrUniqueViolation) {
+		t.Fatalf("ReplaceCollection = %v, want ErrUniqueViolation", err)
+	}
+
+	if n, _ := db.EstimateCount("users"); n != 6 {
+		t.Errorf("%d records after a failed replace, want the original 6", n)
+	}
+}
+
+func TestReadAllRaw(t *testing.T) {
+	db := newTestDriver(t, &Options{CompressOverBytes: 64})
+	writeEmployees(t, db)
+	if err := ioutil.WriteFile(filepath.Join(db.Dir(), "users", "Levi.json.tmp"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := db.ReadAllRaw("users")
+	if err != nil {
+		t.Fatalf("ReadAllRaw: %v", err)
+	}
+	if len(records) != 6 {
+		t.Fatalf("ReadAllRaw returned %d records, want 6", len(records))
+	}
+	for i, r := range records {
+		if !json.Valid(r) {
+			t.Errorf("record %d is not valid JSON: %s", i, r)
+		}
+	}
+
+	var u User
+	if err := json.Unmarshal(records[0], &u); err != nil || u.Name != "Eren" {
+		t.Errorf("first record = %+v, %v, want Eren", u, err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(db.Dir(), "users", "Broken.json"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ReadAllRaw("users"); err == nil {
+		t.Error("ReadAllRaw accepted a record that isn't JSON")
+	}
+}
+
+func TestRejectEmptyRecords(t *testing.T) {
+	db := newTestDriver(t, &Options{RejectEmptyRecords: true})
+
+	type optional struct {
+		Name string `json:",omitempty"`
+	}
+	for name, v := range map[string]interface{}{
+		"nil":       nil,
+		"empty map": map[string]string{},
+		"omitempty": optional{},
+	} {
+		if err := db.Write("users", "x", v); !errors.Is(err, ErrEmptyRecord) {
+			t.Errorf("Write(%s) = %v, want ErrEmptyRecord", name, err)
+		}
+	}
+	if err := db.WriteBatch("users", map[string]interface{}{"x": nil}); !errors.Is(err, ErrEmptyRecord) {
+		t.Errorf("WriteBatch with a nil record = %v, want ErrEmptyRecord", err)
+	}
+
+	if err := db.Write("users", "Eren", optional{Name: "Eren"}); err != nil {
+		t.Errorf("Write of a normal record: %v", err)
+	}
+	if err := db.Write("users", "list", []int{}); err != nil {
+		t.Errorf("Write of an empty array: %v", err)
+	}
+
+	if err := newTestDriver(t, nil).Write("users", "x", nil); err != nil {
+		t.Errorf("Write(nil) without the option: %v", err)
+	}
+}
+
+func TestHierarchicalKeys(t *testing.T) {
+	db := newTestDriver(t, &Options{HierarchicalKeys: true})
+
+	keys := []string{"2024/invoices/0001", "2024/invoices/0002", "2025/0001", "top"}
+	for _, key := range keys {
+		if err := db.Write("billing", key, map[string]string{"key": key}); err != nil {
+			t.Fatalf("Write %s: %v", key, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(db.Dir(), "billing", "2024", "invoices", "0001.json")); err != nil {
+		t.Errorf("hierarchical key not stored in nested directories: %v", err)
+	}
+
+	for _, key := range keys {
+		var v map[string]string
+		if err := db.Read("billing", key, &v); err != nil || v["key"] != key {
+			t.Errorf("Read %s = %v, %v", key, v, err)
+		}
+	}
+
+	records, err := db.ReadAll("billing")
+	if err != nil || len(records) != len(keys) {
+		t.Errorf("ReadAll = %d records, %v, want %d", len(records), err, len(keys))
+	}
+	var walked []string
+	err = db.eachRecordFile("billing", func(resource, path string, fi os.FileInfo) error {
+		walked = append(walked, resource)
+		return nil
+	})
+	if err != nil || !reflect.DeepEqual(walked, keys) {
+		t.Errorf("walked keys = %v, %v, want %v", walked, err, keys)
+	}
+
+	var buf bytes.Buffer
+	if err := db.ExportZip(&buf); err != nil {
+		t.Fatalf("ExportZip: %v", err)
+	}
+	copied := newTestDriver(t, &Options{HierarchicalKeys: true})
+	if err := copied.ImportZip(bytes.NewReader(buf.Bytes()), int64(buf.Len())); err != nil {
+		t.Fatalf("ImportZip: %v", err)
+	}
+	if n, _ := copied.EstimateCount("billing"); n != len(keys) {
+		t.Errorf("imported %d records, want %d", n, len(keys))
+	}
+
+	if err := db.Delete("billing", "2024/invoices/0001"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if n, _ := db.EstimateCount("billing"); n != len(keys)-1 {
+		t.Errorf("EstimateCount after Delete = %d, want %d", n, len(keys)-1)
+	}
+
+	for _, key := range []string{"../escape", "2024/../../escape", "2024//0001", "/abs", "2024/."} {
+		if err := db.Write("billing", key, 1); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Write %q = %v, want ErrInvalidKey", key, err)
+		}
+	}
+	if err := db.Delete("billing", "../billing"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Delete of a traversing key = %v, want ErrInvalidKey", err)
+	}
+}
+
+func TestFlatKeysRejectSeparators(t *testing.T) {
+	db := newTestDriver(t, nil)
+
+	for _, key := range []string{"a/b", "..", "../users/Eren"} {
+		if err := db.Write("users", key, User{}); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Write %q = %v, want ErrInvalidKey", key, err)
+		}
+		var u User
+		if err := db.Read("users", key, &u); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Read %q = %v, want ErrInvalidKey", key, err)
+		}
+	}
+}
+
+func TestDetectCaseCollision(t *testing.T) {
+	db := newTestDriver(t, &Options{DetectCaseCollision: true, CompressOverBytes: 1})
+
+	if err := db.Write("users", "eren", User{Name: "eren"}); err != nil {
+		t.Fatalf("Write eren: %v", err)
+	}
+	// Rewriting the same name is not a collision.
+	if err := db.Write("users", "eren", User{Name: "eren", Age: "19"}); err != nil {
+		t.Fatalf("rewriting eren: %v", err)
+	}
+
+	// This test runs on case-sensitive filesystems too, where the files
+	// could coexist; the check compares names rather than relying on the
+	// filesystem folding them.
+	err := db.Write("users", "Eren", User{Name: "Eren"})
+	if !errors.Is(err, ErrCaseCollision) {
+		t.Fatalf("Write Eren = %v, want ErrCaseCollision", err)
+	}
+
+	var u User
+	if err := db.Read("users", "eren", &u); err != nil || u.Age != "19" {
+		t.Errorf("Read eren = %+v, %v, want it untouched", u, err)
+	}
+}
+
+func TestKeepBackupRollback(t *testing.T) {
+	db := newTestDriver(t, &Options{KeepBackup: true, CacheSize: 10})
+
+	if err := db.Rollback("users", "Eren"); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Rollback without a backup = %v, want ErrRecordNotFound", err)
+	}
+
+	for _, company := range []string{"Survey Corps", "Marley"} {
+		if err := db.Write("users", "Eren", User{Name: "Eren", Company: company}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(db.Dir(), "users", "Eren.json.bak")); err != nil {
+		t.Fatalf("no backup kept: %v", err)
+	}
+	records, err := db.ReadAll("users")
+	if err != nil || len(records) != 1 {
+		t.Errorf("ReadAll = %d records, %v, want 1", len(records), err)
+	}
+	if keys, err := db.KeysByModTime("users", false); err != nil || !reflect.DeepEqual(keys, []string{"Eren"}) {
+		t.Errorf("KeysByModTime = %v, %v, want [Eren]", keys, err)
+	}
+
+	if err := db.Rollback("users", "Eren"); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+	var u User
+	if err := db.Read("users", "Eren", &u); err != nil || u.Company != "Survey Corps" {
+		t.Errorf("Read after Rollback = %+v, %v, want the first version", u, err)
+	}
+	if err := db.Rollback("users", "Eren"); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("second Rollback = %v, want ErrRecordNotFound", err)
+	}
+
+	if err := db.Delete("users", "Eren"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := db.Rollback("users", "Eren"); err != nil {
+		t.Fatalf("Rollback of a delete: %v", err)
+	}
+	if err := db.Read("users", "Eren", &u); err != nil || u.Company != "Survey Corps" {
+		t.Errorf("Read after undoing Delete = %+v, %v", u, err)
+	}
+}
+
+func TestMaxReadAllRecords(t *testing.T) {
+	db := newTestDriver(t, &Options{MaxReadAllRecords: 6})
+	writeEmployees(t, db)
+
+	// Files that aren't records don't count toward the limit.
+	for _, name := range []string{"Eren.json.tmp", "notes.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(db.Dir(), "users", name), []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if records, err := db.ReadAll("users"); err != nil || len(records) != 6 {
+		t.Fatalf("ReadAll at the limit = %d records, %v", len(records), err)
+	}
+
+	if err := db.Write("users", "Levi", User{Name: "Levi"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if records, err := db.ReadAll("users"); !errors.Is(err, ErrResultTooLarge) || records != nil {
+		t.Errorf("ReadAll past the limit = %d records, %v, want ErrResultTooLarge", len(records), err)
+	}
+}
+
+func TestDeleteAndReturn(t *testing.T) {
+	db := newTestDriver(t, &Options{CacheSize: 10})
+	writeEmployees(t, db)
+
+	var u User
+	if err := db.DeleteAndReturn("users", "Eren", &u); err != nil {
+		t.Fatalf("DeleteAndReturn: %v", err)
+	}
+	if u.Name != "Eren" || u.Company != "Domini" {
+		t.Errorf("DeleteAndReturn returned %+v, want Eren's record", u)
+	}
+	if _, err := os.Stat(filepath.Join(db.Dir(), "users", "Eren.json")); !os.IsNotExist(err) {
+		t.Errorf("record file still there after DeleteAndReturn: %v", err)
+	}
+	if err := db.Read("users", "Eren", &u); !os.IsNotExist(err) {
+		t.Errorf("Read after DeleteAndReturn = %v, want not found", err)
+	}
+
+	if err := db.DeleteAndReturn("users", "Eren", &u); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("DeleteAndReturn of a missing record = %v, want ErrRecordNotFound", err)
+	}
+
+	var wrong []int
+	if err := db.DeleteAndReturn("users", "Mikasa", &wrong); err == nil {
+		t.Error("DeleteAndReturn into the wrong type succeeded")
+	}
+	if err := db.Read("users", "Mikasa", &u); err != nil {
+		t.Errorf("record deleted despite the failed decode: %v", err)
+	}
+}
+
+func TestMapCollection(t *testing.T) {
+	db := newTestDriver(t, nil)
+	writeEmployees(t, db)
+
+	updated, err := db.MapCollection("users", func(resource string, raw []byte) ([]byte, error) {
+		var u User
+		if err := json.Unmarshal(raw, &u); err != nil {
+			return nil, err
+		}
+		country := strings.ToUpper(u.Address.Country)
+		if country == u.Address.Country {
+			return raw, nil
+		}
+		u.Address.Country = country
+		return json.Marshal(u)
+	})
+	if err != nil {
+		t.Fatalf("MapCollection: %v", err)
+	}
+	// Johan's USA is already upper case, so only the other five change.
+	if updated != 5 {
+		t.Errorf("updated = %d, want 5", updated)
+	}
+
+	for _, name := range []string{"Mikasa", "Johan", "Reiner"} {
+		var u User
+		if err := db.Read("users", name, &u); err != nil {
+			t.Fatalf("Read %s: %v", name, err)
+		}
+		if u.Address.Country != strings.ToUpper(u.Address.Country) {
+			t.Errorf("%s Country = %q, want upper case", name, u.Address.Country)
+		}
+	}
+
+	failed := errors.New("stop")
+	if _, err := db.MapCollection("users", func(string, []byte) ([]byte, error) {
+		return nil, failed
+	}); !errors.Is(err, failed) {
+		t.Errorf("MapCollection with failing fn = %v, want %v", err, failed)
+	}
+}
+
+func TestWriteBatchResults(t *testing.T) {
+	db := newTestDriver(t, &Options{
+		Transform: func(collection, resource string, v interface{}) (interface{}, error) {
+			if u, ok := v.(User); ok && u.Company == "" {
+				return nil, errors.New("no company")
+			}
+			return v, nil
+		},
+	})
+	if err := db.SetUnique("users", "Contact"); err != nil {
+		t.Fatalf("SetUnique: %v", err)
+	}
+
+	results := db.WriteBatchResults("users", map[string]interface{}{
+		"Eren":   User{Name: "Eren", Contact: "1", Company: "Domini"},
+		"Mikasa": User{Name: "Mikasa", Contact: "1", Company: "cedar"},
+		"Levi":   User{Name: "Levi", Contact: "2"},
+		"../x":   User{Name: "x", Contact: "3", Company: "x"},
+		"Armin":  User{Name: "Armin", Contact: "4", Company: "Survey Corps"},
+	})
+	if len(results) != 5 {
+		t.Fatalf("got %d results, want one per record: %v", len(results), results)
+	}
+	for _, resource := range []string{"Eren", "Armin"} {
+		if err := results[resource]; err != nil {
+			t.Errorf("%s: %v, want written", resource, err)
+		}
+	}
+	if err := results["Mikasa"]; !errors.Is(err, ErrUniqueViolation) {
+		t.Errorf("Mikasa: %v, want ErrUniqueViolation", err)
+	}
+	if err := results["Levi"]; err == nil || err.Error() != "no company" {
+		t.Errorf("Levi: %v, want the Transform's error", err)
+	}
+	if err := results["../x"]; !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("../x: %v, want ErrInvalidKey", err)
+	}
+
+	if n, _ := db.EstimateCount("users"); n != 2 {
+		t.Errorf("%d records written, want 2", n)
+	}
+}
+
+func TestReadMulti(t *testing.T) {
+	db := newTestDriver(t, nil)
+	writeEmployees(t, db)
+
+	reads := &countingStorage{}
+	db.storage = reads
+
+	var u User
+	var m map[string]interface{}
+	if err := db.ReadMulti("users", "Eren", &u, &m); err != nil {
+		t.Fatalf("ReadMulti: %v", err)
+	}
+	if u.Name != "Eren" || m["Company"] != "Domini" {
+		t.Errorf("ReadMulti decoded %+v and %v", u, m)
+	}
+	if reads.reads != 1 {
+		t.Errorf("ReadMulti read the file %d times, want once", reads.reads)
+	}
+}
+
+func TestKeyPolicy(t *testing.T) {
+	db := newTestDriver(t, &Options{KeyPolicy: &KeyPolicy{
+		MaxLength: 8,
+		Allowed:   regexp.MustCompile(`^[a-z0-9-]+$`),
+	}})
+
+	if err := db.Write("users", "eren-1", User{Name: "Eren"}); err != nil {
+		t.Fatalf("Write of an allowed key: %v", err)
+	}
+
+	for _, key := range []string{"much-too-long", "Eren", "eren_1"} {
+		if err := db.Write("users", key, User{}); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("Write %q = %v, want ErrInvalidName", key, err)
+		}
+		var u User
+		if err := db.Read("users", key, &u); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("Read %q = %v, want ErrInvalidName", key, err)
+		}
+		if err := db.Delete("users", key); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("Delete %q = %v, want ErrInvalidName", key, err)
+		}
+	}
+	if err := db.Write("users", "much-too-long", User{}); err == nil || !strings.Contains(err.Error(), "longer than 8") {
+		t.Errorf("over-length error %v doesn't name the rule", err)
+	}
+}
+
+func TestDefaultKeyPolicy(t *testing.T) {
+	db := newTestDriver(t, nil)
+
+	if err := db.Write("users", strings.Repeat("a", 201), User{}); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("Write of a 201 byte key = %v, want ErrInvalidName", err)
+	}
+	if err := db.Write("users", "bad\nkey", User{}); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("Write of a key with a newline = %v, want ErrInvalidName", err)
+	}
+	if err := db.Write("users", "Eren Yeager, 2", User{}); err != nil {
+		t.Errorf("Write of an ordinary key: %v", err)
+	}
+}
+
+func TestPruneOlderThan(t *testing.T) {
+	db := newTestDriver(t, &Options{CacheSize: 10})
+	writeEmployees(t, db)
+
+	old := time.Now().Add(-48 * time.Hour)
+	for _, name := range []string{"Eren", "Johan"} {
+		if err := os.Chtimes(filepath.Join(db.Dir(), "users", name+".json"), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := db.PruneOlderThan("users", 24*time.Hour)
+	if err != nil || removed != 2 {
+		t.Fatalf("PruneOlderThan = %d, %v, want 2", removed, err)
+	}
+
+	var u User
+	for _, name := range []string{"Eren", "Johan"} {
+		if err := db.Read("users", name, &u); !os.IsNotExist(err) {
+			t.Errorf("Read of pruned %s = %v, want not found", name, err)
+		}
+	}
+	if n, _ := db.EstimateCount("users"); n != 4 {
+		t.Errorf("%d records left, want 4", n)
+	}
+}
+
+func TestKeySnapshotDiff(t *testing.T) {
+	db := newTestDriver(t, nil)
+	writeEmployees(t, db)
+
+	snapshot, err := db.KeySnapshot("users")
+	if err != nil || len(snapshot) != 6 {
+		t.Fatalf("KeySnapshot = %v, %v, want 6 keys", snapshot, err)
+	}
+
+	if err := db.Write("users", "Levi", User{Name: "Levi"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := db.Delete("users", "Johan"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(db.Dir(), "users", "Eren.json"), later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	added, removed, changed, err := db.DiffKeySnapshot("users", snapshot)
+	if err != nil {
+		t.Fatalf("DiffKeySnapshot: %v", err)
+	}
+	if !reflect.DeepEqual(added, []string{"Levi"}) || !reflect.DeepEqual(removed, []string{"Johan"}) || !reflect.DeepEqual(changed, []string{"Eren"}) {
+		t.Errorf("DiffKeySnapshot = added %v, removed %v, changed %v", added, removed, changed)
+	}
+}
+
+func TestWriteIfChanged(t *testing.T) {
+	db := newTestDriver(t, nil)
+
+	if changed, err := db.WriteIfChanged("users", "Eren", User{Name: "Eren"}); !changed || err != nil {
+		t.Fatalf("WriteIfChanged of a new record = %v, %v, want written", changed, err)
+	}
+
+	path := filepath.Join(db.Dir(), "users", "Eren.json")
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(path, past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	if changed, err := db.WriteIfChanged("users", "Eren", User{Name: "Eren"}); changed || err != nil {
+		t.Fatalf("WriteIfChanged of the same record = %v, %v, want no write", changed, err)
+	}
+	if fi, err := os.Stat(path); err != nil || !fi.ModTime().Equal(past) {
+		t.Errorf("no-op WriteIfChanged touched the file: %v, %v", fi.ModTime(), err)
+	}
+
+	if changed, err := db.WriteIfChanged("users", "Eren", User{Name: "Eren", Age: "19"}); !changed || err != nil {
+		t.Fatalf("WriteIfChanged of a changed record = %v, %v, want written", changed, err)
+	}
+	var u User
+	if err := db.Read("users", "Eren", &u); err != nil || u.Age != "19" {
+		t.Errorf("Read = %+v, %v, want Age 19", u, err)
+	}
+}
+
+func TestTryWrite(t *testing.T) {
+	db := newTestDriver(t, nil)
+
+	if ok, err := db.TryWrite("users", "Eren", User{Name: "Eren"}); !ok || err != nil {
+		t.Fatalf("TryWrite on a free lock = %v, %v, want written", ok, err)
+	}
+
+	held := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		mutex := db.lockCollection("users")
+		close(held)
+		<-release
+		mutex.Unlock()
+	}()
+	<-held
+
+	ok, err := db.TryWrite("users", "Eren", User{Name: "Eren", Company: "Marley"})
+	close(release)
+	if ok || err != nil {
+		t.Errorf("TryWrite on a held lock = %v, %v, want false, nil", ok, err)
+	}
+
+	var u User
+	if err := db.Read("users", "Eren", &u); err != nil || u.Company != "" {
+		t.Errorf("Read = %+v, %v, want the first write only", u, err)
+	}
+}
+
+func TestGrep(t *testing.T) {
+	db := newTestDriver(t, nil)
+	writeEmployees(t, db)
+
+	keys, err := db.Grep("users", "Google", false)
+	if err != nil || !reflect.DeepEqual(keys, []string{"Johan"}) {
+		t.Errorf("Grep Google = %v, %v, want [Johan]", keys, err)
+	}
+
+	keys, err = db.Grep("users", "INDIA", false)
+	if err != nil || len(keys) != 0 {
+		t.Errorf("case-sensitive Grep INDIA = %v, %v, want none", keys, err)
+	}
+
+	keys, err = db.Grep("users", "INDIA", true)
+	if err != nil || !reflect.DeepEqual(keys, []string{"Erwin", "Mikasa"}) {
+		t.Errorf("case-insensitive Grep INDIA = %v, %v, want [Erwin Mikasa]", keys, err)
+	}
+}
+
+func TestAllKeys(t *testing.T) {
+	db := newTestDriver(t, nil)
+	writeEmployees(t, db)
+	if err := db.Write("orders", "1", []int{1}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(db.Dir(), "users", "Levi.json.tmp"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.NextSeq("orders"); err != nil {
+		t.Fatalf("NextSeq: %v", err)
+	}
+
+	keys, errs := db.AllKeys()
+	var got []CollectionResource
+	for key := range keys {
+		got = append(got, key)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("AllKeys: %v", err)
+	}
+
+	want := []CollectionResource{{"orders", "1"}}
+	for _, name := range []string{"Eren", "Erwin", "Johan", "Maximilian", "Mikasa", "Reiner"} {
+		want = append(want, CollectionResource{"users", name})
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("AllKeys = %v, want %v", got, want)
+	}
+}
+
+func TestReadPairs(t *testing.T) {
+	db := newTestDriver(t, nil)
+	writeEmployees(t, db)
+	if err := db.Write("orders", "1", map[string]string{"user": "Eren"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	eren := CollectionResource{"users", "Eren"}
+	order := CollectionResource{"orders", "1"}
+	missing := CollectionResource{"orders", "2"}
+	records, err := db.ReadPairs([]CollectionResource{eren, order, missing, {"users", "Mikasa"}})
+	if err != nil {
+		t.Fatalf("ReadPairs: %v", err)
+	}
+	if len(records) != 3 {
+		t.Errorf("ReadPairs returned %d records, want 3", len(records))
+	}
+	if _, ok := records[missing]; ok {
+		t.Error("ReadPairs returned a record that doesn't exist")
+	}
+
+	var u User
+	if err := json.Unmarshal(records[eren], &u); err != nil || u.Name != "Eren" {
+		t.Errorf("users/Eren = %s, %v", records[eren], err)
+	}
+	var o map[string]string
+	if err := json.Unmarshal(records[order], &o); err != nil || o["user"] != "Eren" {
+		t.Errorf("orders/1 = %s, %v", records[order], err)
+	}
+}
+
+func TestPermMask(t *testing.T) {
+	db := newTestDriver(t, &Options{PermMask: 0077})
+
+	if err := db.Write("users", "Eren", User{Name: "Eren"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	for path, want := range map[string]os.FileMode{
+		db.Dir():                         0700,
+		filepath.Join(db.Dir(), "users"): 0700,
+		filepath.Join(db.Dir(), "users", "Eren.json"): 0600,
+	} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+		if got := fi.Mode().Perm(); got != want {
+			t.Errorf("%s has mode %o, want %o", path, got, want)
+		}
+	}
+}
+
+func TestFlushCollection(t *testing.T) {
+	db := newTestDriver(t, &Options{HierarchicalKeys: true})
+	writeEmployees(t, db)
+	if err := db.Write("users", "archive/Levi", User{Name: "Levi"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if err := db.Write("orders", "1", []int{1}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	var synced []string
+	db.beforeSync = func(path string) {
+		rel, err := filepath.Rel(db.Dir(), path)
+		if err != nil {
+			t.Errorf("synced %s outside the database: %v", path, err)
+		}
+		synced = append(synced, filepath.ToSlash(rel))
+	}
+
+	if err := db.FlushCollection("users"); err != nil {
+		t.Errorf("FlushCollection: %v", err)
+	}
+	// Exactly the users records and their directories; orders and the
+	// files outside users are left alone.
+	sort.Strings(synced)
+	want := []string{
+		"users",
+		"users/Eren.json",
+		"users/Erwin.json",
+		"users/Johan.json",
+		"users/Maximilian.json",
+		"users/Mikasa.json",
+		"users/Reiner.json",
+		"users/archive",
+		"users/archive/Levi.json",
+	}
+	if !reflect.DeepEqual(synced, want) {
+		t.Errorf("synced %v, want %v", synced, want)
+	}
+
+	if err := db.FlushCollection("missing"); err == nil {
+		t.Error("FlushCollection of a missing collection succeeded")
+	}
+}
+
+func TestReadPageWithTotal(t *testing.T) {
+	db := newTestDriver(t, nil)
+	writeEmployees(t, db)
+
+	records, total, err := db.ReadPageWithTotal("users", 2, 2)
+	if err != nil {
+		t.Fatalf("ReadPageWithTotal: %v", err)
+	}
+	if total != 6 {
+		t.Errorf("total = %d, want 6", total)
+	}
+
+	// In name order: Eren, Erwin, Johan, Maximilian, Mikasa, Reiner.
+	var names []string
+	for _, r := range records {
+		var u User
+		if err := json.Unmarshal([]byte(r), &u); err != nil {
+			t.Fatalf("record %s: %v", r, err)
+		}
+		names = append(names, u.Name)
+	}
+	if want := []string{"Johan", "Maximilian"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("page = %v, want %v", names, want)
+	}
+
+	if records, total, err := db.ReadPageWithTotal("users", 5, 10); err != nil || len(records) != 1 || total != 6 {
+		t.Errorf("last page = %d records, total %d, %v, want 1 of 6", len(records), total, err)
+	}
+	if _, _, err := db.ReadPageWithTotal("users", -1, 2); err == nil {
+		t.Error("ReadPageWithTotal accepted a negative offset")
+	}
+}
+
+func TestPostRead(t *testing.T) {
+	var rejected = errors.New("rejected")
+	db := newTestDriver(t, &Options{
+		PostRead: func(collection, resource string, v interface{}) error {
+			u, ok := v.(*User)
+			if !ok {
+				return nil
+			}
+			if resource == "Reiner" {
+				return rejected
+			}
+			u.Company = strings.ToUpper(u.Company)
+			return nil
+		},
+		OnDecodeError: SkipOnDecodeError,
+	})
+	writeEmployees(t, db)
+
+	var u User
+	if err := db.Read("users", "Eren", &u); err != nil || u.Company != "DOMINI" {
+		t.Errorf("Read = %+v, %v, want the company uppercased", u, err)
+	}
+	if err := db.Read("users", "Reiner", &u); !errors.Is(err, rejected) {
+		t.Errorf("Read of a rejected record = %v, want the hook's error", err)
+	}
+
+	var m map[string]interface{}
+	if err := db.ReadMulti("users", "Johan", &u, &m); err != nil || u.Company != "GOOGLE" || m["Company"] != "Google" {
+		t.Errorf("ReadMulti = %+v, %v, %v", u, m, err)
+	}
+
+	users, err := ReadAllTyped[User](db, "users")
+	if err != nil || len(users) != 5 {
+		t.Fatalf("ReadAllTyped = %d users, %v, want 5 with Reiner rejected", len(users), err)
+	}
+	for _, u := range users {
+		if u.Company != strings.ToUpper(u.Company) {
+			t.Errorf("ReadAllTyped returned %s's company %q unnormalized", u.Name, u.Company)
+		}
+	}
+}
+
+func TestNeedsRecovery(t *testing.T) {
+	db := newTestDriver(t, nil)
+	writeEmployees(t, db)
+
+	if needed, leftovers, err := db.NeedsRecovery(); err != nil || needed || len(leftovers) != 0 {
+		t.Errorf("NeedsRecovery on a clean database = %v, %v, %v", needed, leftovers, err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(db.Dir(), "users", "Levi.json.tmp"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(db.Dir(), "orders"+replacingSuffix), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	needed, leftovers, err := db.NeedsRecovery()
+	if err != nil {
+		t.Fatalf("NeedsRecovery: %v", err)
+	}
+	if want := []string{"orders.replacing", "users/Levi.json.tmp"}; !needed || !reflect.DeepEqual(leftovers, want) {
+		t.Errorf("NeedsRecovery = %v, %v, want true, %v", needed, leftovers, want)
+	}
+}
+
+func TestTryRead(t *testing.T) {
+	db := newTestDriver(t, nil)
+	writeCorruptUsers(t, db)
+
+	var u User
+	if found, err := db.TryRead("users", "Eren", &u); !found || err != nil || u.Name != "Eren" {
+		t.Errorf("TryRead of a present record = %v, %v, %+v", found, err, u)
+	}
+	if found, err := db.TryRead("users", "Levi", &u); found || err != nil {
+		t.Errorf("TryRead of an absent record = %v, %v, want false, nil", found, err)
+	}
+	if found, err := db.TryRead("missing", "Levi", &u); found || err != nil {
+		t.Errorf("TryRead in an absent collection = %v, %v, want false, nil", found, err)
+	}
+	if found, err := db.TryRead("users", "Broken", &u); !found || err == nil {
+		t.Errorf("TryRead of a corrupt record = %v, %v, want true and an error", found, err)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	db := newTestDriver(t, &Options{CacheSize: 10})
+	writeEmployees(t, db)
+	if _, err := db.NextSeq("users"); err != nil {
+		t.Fatalf("NextSeq: %v", err)
+	}
+
+	archive, err := db.Rotate("users")
+	if err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	if !strings.HasPrefix(archive, "users-") {
+		t.Errorf("archive name %q doesn't start with the collection's", archive)
+	}
+
+	if records, err := db.ReadAll("users"); err != nil || len(records) != 0 {
+		t.Errorf("live collection after Rotate = %d records, %v, want empty", len(records), err)
+	}
+	var u User
+	if err := db.Read("users", "Eren", &u); !os.IsNotExist(err) {
+		t.Errorf("Read from the rotated collection = %v, want not found", err)
+	}
+	if seq, err := db.CurrentSeq("users"); err != nil || seq != 1 {
+		t.Errorf("CurrentSeq after Rotate = %d, %v, want the sequence kept", seq, err)
+	}
+
+	if n, err := db.EstimateCount(archive); err != nil || n != 6 {
+		t.Errorf("archive holds %d records, %v, want 6", n, err)
+	}
+	if err := db.Read(archive, "Eren", &u); err != nil || u.Name != "Eren" {
+		t.Errorf("Read from the archive = %+v, %v", u, err)
+	}
+
+	if _, err := db.Rotate("missing"); err == nil {
+		t.Error("Rotate of a missing collection succeeded")
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Manager opens and caches the Drivers of several databases kept side by
+// side under one root directory, all sharing the same Options.
+type Manager struct {
+	mutex   sync.Mutex
+	root    string
+	options *Options
+	dbs     map[string]*Driver
+}
+
+func NewManager(root string, options *Options) *Manager {
+	return &Manager{
+		root:    filepath.Clean(root),
+		options: options,
+		dbs:     make(map[string]*Driver),
+	}
+}
+
+// DB returns the Driver for the database called name, stored in root/name,
+// creating the database on first use. Every call with the same name returns
+// the same Driver.
+func (m *Manager) DB(name string) (*Driver, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return nil, fmt.Errorf("invalid database name %q", name)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if db, ok := m.dbs[name]; ok {
+		return db, nil
+	}
+
+	db, err := New(filepath.Join(m.root, name), m.options)
+	if err != nil {
+		return nil, err
+	}
+	m.dbs[name] = db
+
+	return db, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestManagerIsolatesDatabases(t *testing.T) {
+	root := t.TempDir()
+	m := NewManager(root, nil)
+
+	a, err := m.DB("a")
+	if err != nil {
+		t.Fatalf("DB(a): %v", err)
+	}
+	b, err := m.DB("b")
+	if err != nil {
+		t.Fatalf("DB(b): %v", err)
+	}
+	if again, _ := m.DB("a"); again != a {
+		t.Error("DB(a) returned a different Driver the second time")
+	}
+
+	if err := a.Write("users", "Eren", User{Name: "Eren"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	var u User
+	if err := b.Read("users", "Eren", &u); err == nil {
+		t.Error("record written to a is visible in b")
+	}
+	if err := a.Read("users", "Eren", &u); err != nil {
+		t.Errorf("Read from a: %v", err)
+	}
+
+	if _, err := NewManager(root, nil).DB("a"); err != nil {
+		t.Errorf("reopening a from a new Manager: %v", err)
+	}
+
+	if _, err := m.DB("../escape"); err == nil {
+		t.Error("DB accepted a name with a path separator")
+	}
+}
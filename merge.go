@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// ErrConflict is returned by MergeFrom with FailOnConflict when both
+// databases hold a record under the same key with different contents.
+var ErrConflict = errors.New("conflicting records")
+
+// Resolution decides what MergeFrom does with a record both databases hold
+// with different contents.
+type Resolution int
+
+const (
+	// KeepExisting leaves this database's record in place.
+	KeepExisting Resolution = iota
+	// TakeOther overwrites it with the other database's record.
+	TakeOther
+	// KeepNewer keeps whichever of the two was written last, going by
+	// their files' modification times, and this database's on a tie.
+	KeepNewer
+	// FailOnConflict stops the merge with ErrConflict.
+	FailOnConflict
+)
+
+// MergeFrom copies every record of every collection in other into this
+// database, resolving records both hold with different contents as
+// onConflict says. Records are translated between the databases' field
+// maps, but both must use the same Codec. Each collection of other is read
+// under its lock and then written under this database's, so a failure part
+// way through leaves the collections merged so far in place.
+func (d *Driver) MergeFrom(other *Driver, onConflict Resolution) error {
+	if other == d {
+		return fmt.Errorf("unable to merge a database into itself")
+	}
+	if reflect.TypeOf(other.codec) != reflect.TypeOf(d.codec) {
+		return fmt.Errorf("unable to merge - records are stored with %T here and %T there", d.codec, other.codec)
+	}
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+
+	collections, err := other.collections()
+	if err != nil {
+		return err
+	}
+
+	for _, collection := range collections {
+		records, err := other.mergeRecords(collection)
+		if err != nil {
+			return err
+		}
+
+		if err := d.mergeCollection(collection, records, onConflict); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type mergeRecord struct {
+	resource string
+	plain    []byte
+	modTime  time.Time
+}
+
+// mergeRecords reads a collection's records, with field names restored,
+// under the collection's lock.
+func (d *Driver) mergeRecords(collection string) ([]mergeRecord, error) {
+	mutex := d.lockCollection(collection)
+	defer mutex.Unlock()
+
+	var records []mergeRecord
+	err := d.eachRecordFile(collection, func(resource, path string, fi os.FileInfo) error {
+		b, err := d.readRecordFile(path)
+		if err != nil {
+			return err
+		}
+		if b, err = d.plain(collection, b); err != nil {
+			return err
+		}
+
+		records = append(records, mergeRecord{resource, b, fi.ModTime()})
+		return nil
+	})
+
+	return records, err
+}
+
+func (d *Driver) mergeCollection(collection string, records []mergeRecord, onConflict Resolution) error {
+	mapping := d.fieldMap(collection)
+
+	mutex := d.lockCollection(collection)
+	defer mutex.Unlock()
+
+	for _, r := range records {
+		b, err := d.stored(r.plain, mapping)
+		if err != nil {
+			return err
+		}
+
+		path, fi, err := d.recordFile(collection, r.resource)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return err
+		default:
+			existing, err := d.readRecordFile(path)
+			if err != nil {
+				return err
+			}
+			if bytes.Equal(existing, b) {
+				continue
+			}
+
+			switch onConflict {
+			case KeepExisting:
+				continue
+			case KeepNewer:
+				if !r.modTime.After(fi.ModTime()) {
+					continue
+				}
+			case FailOnConflict:
+				return fmt.Errorf("%w: %s/%s", ErrConflict, collection, r.resource)
+			}
+		}
+
+		if err := d.writeRecord(collection, r.resource, b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Coalesce moves the records of every collection whose name starts with
+// prefix into the collection into, then deletes the emptied collections.
+// Each record is re-keyed with its old collection's name in front, joined
+// by "/" with HierarchicalKeys set, so it lands in a directory of into,
+// and by "_" otherwise. A moved record whose new key is already taken in
+// into fails the call with ErrConflict. Everything involved stays locked
+// throughout, but a failure part way through leaves the records moved so
+// far in place.
+func (d *Driver) Coalesce(prefix string, into string) error {
+	if prefix == "" {
+		return fmt.Errorf("missing prefix - no collections to coalesce")
+	}
+	if into == "" {
+		return fmt.Errorf("missing collection - no place to save records")
+	}
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+
+	collections, err := d.collections()
+	if err != nil {
+		return err
+	}
+
+	var sources []string
+	for _, collection := range collections {
+		if strings.HasPrefix(collection, prefix) && collection != into {
+			sources = append(sources, collection)
+		}
+	}
+	if len(sources) == 0 {
+		return nil
+	}
+
+	sep := "_"
+	if d.hierarchical {
+		sep = "/"
+	}
+	mapping := d.fieldMap(into)
+
+	return d.withTimeout(func() error {
+		unlock := d.lockDelete(append([]string{into}, sources...)...)
+		defer unlock()
+
+		for _, source := range sources {
+			err := d.eachRecordFile(source, func(resource, path string, fi os.FileInfo) error {
+				key := source + sep + resource
+				if err := d.checkResource(key); err != nil {
+					return err
+				}
+				if _, _, err := d.recordFile(into, key); err == nil {
+					return fmt.Errorf("%w: %s/%s already exists", ErrConflict, into, key)
+				} else if !os.IsNotExist(err) {
+					return err
+				}
+
+				b, err := d.readRecordFile(path)
+				if err != nil {
+					return err
+				}
+				if b, err = d.plain(source, b); err != nil {
+					return err
+				}
+				if b, err = d.stored(b, mapping); err != nil {
+					return err
+				}
+
+				return d.writeRecord(into, key, b)
+			})
+			if err != nil {
+				return err
+			}
+
+			if err := d.deleteLocked(source, ""); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// stored turns a record's bytes with field names restored back into the
+// form a collection with the given field mapping stores them in.
+func (d *Driver) stored(plain []byte, mapping map[string]string) ([]byte, error) {
+	b := plain
+	if mapping != nil {
+		var err error
+		if b, err = renameFields(b, mapping); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := d.codec.(JSONCodec); ok && d.canonical {
+		return canonicalize(b)
+	}
+
+	return b, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMergeFrom(t *testing.T) {
+	shards := func() (*Driver, *Driver) {
+		dst := newTestDriver(t, nil)
+		src := newTestDriver(t, nil)
+		src.SetFieldMap("users", map[string]string{"Company": "c"})
+
+		if err := dst.Write("users", "Eren", User{Name: "Eren", Company: "Survey Corps"}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if err := dst.Write("users", "Mikasa", User{Name: "Mikasa", Company: "cedar"}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if err := src.Write("users", "Eren", User{Name: "Eren", Company: "Marley"}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if err := src.Write("users", "Mikasa", User{Name: "Mikasa", Company: "cedar"}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if err := src.Write("orders", "1", map[string]string{"user": "Eren"}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		return dst, src
+	}
+	company := func(db *Driver) string {
+		var u User
+		if err := db.Read("users", "Eren", &u); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		return u.Company
+	}
+
+	dst, src := shards()
+	if err := dst.MergeFrom(src, KeepExisting); err != nil {
+		t.Fatalf("MergeFrom KeepExisting: %v", err)
+	}
+	if got := company(dst); got != "Survey Corps" {
+		t.Errorf("KeepExisting kept %q, want Survey Corps", got)
+	}
+	var order map[string]string
+	if err := dst.Read("orders", "1", &order); err != nil || order["user"] != "Eren" {
+		t.Errorf("merged orders/1 = %v, %v", order, err)
+	}
+
+	dst, src = shards()
+	if err := dst.MergeFrom(src, TakeOther); err != nil {
+		t.Fatalf("MergeFrom TakeOther: %v", err)
+	}
+	if got := company(dst); got != "Marley" {
+		t.Errorf("TakeOther kept %q, want Marley", got)
+	}
+
+	dst, src = shards()
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(dst.Dir(), "users", "Eren.json"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.MergeFrom(src, KeepNewer); err != nil {
+		t.Fatalf("MergeFrom KeepNewer: %v", err)
+	}
+	if got := company(dst); got != "Marley" {
+		t.Errorf("KeepNewer kept %q, want the newer Marley", got)
+	}
+
+	dst, src = shards()
+	if err := dst.MergeFrom(src, FailOnConflict); !errors.Is(err, ErrConflict) {
+		t.Errorf("MergeFrom FailOnConflict = %v, want ErrConflict", err)
+	}
+
+	if err := dst.MergeFrom(dst, TakeOther); err == nil {
+		t.Error("merging a database into itself succeeded")
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	for _, hierarchical := range []bool{false, true} {
+		db := newTestDriver(t, &Options{HierarchicalKeys: hierarchical})
+		sep := "_"
+		if hierarchical {
+			sep = "/"
+		}
+
+		for _, collection := range []string{"cat-books", "cat-films", "cat-games"} {
+			for _, resource := range []string{"1", "2"} {
+				if err := db.Write(collection, resource, User{Name: collection + resource}); err != nil {
+					t.Fatalf("Write: %v", err)
+				}
+			}
+		}
+		if err := db.Write("dogs", "1", User{Name: "dogs1"}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+
+		if err := db.Coalesce("cat-", "cats"); err != nil {
+			t.Fatalf("Coalesce with HierarchicalKeys %v: %v", hierarchical, err)
+		}
+
+		for _, collection := range []string{"cat-books", "cat-films", "cat-games"} {
+			for _, resource := range []string{"1", "2"} {
+				var u User
+				if err := db.Read("cats", collection+sep+resource, &u); err != nil || u.Name != collection+resource {
+					t.Errorf("Read cats/%s%s%s = %+v, %v", collection, sep, resource, u, err)
+				}
+			}
+		}
+
+		counts, err := db.CollectionCounts()
+		if err != nil {
+			t.Fatalf("CollectionCounts: %v", err)
+		}
+		if want := map[string]int{"cats": 6, "dogs": 1}; !reflect.DeepEqual(counts, want) {
+			t.Errorf("CollectionCounts after Coalesce = %v, want %v", counts, want)
+		}
+	}
+}
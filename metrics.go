@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// metrics are the Driver's operation counters, updated atomically.
+type metrics struct {
+	writes       uint64
+	reads        uint64
+	deletes      uint64
+	writtenBytes uint64
+	readBytes    uint64
+}
+
+func (m *metrics) wrote(b []byte) {
+	atomic.AddUint64(&m.writes, 1)
+	atomic.AddUint64(&m.writtenBytes, uint64(len(b)))
+}
+
+// labelEscaper escapes a label value for the text exposition format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WriteMetrics writes the Driver's operation counters, and the number of
+// records in every collection, to w in the Prometheus text exposition
+// format, ready to be served from a metrics endpoint. The counters start
+// from zero when the Driver is created.
+func (d *Driver) WriteMetrics(w io.Writer) error {
+	counts, err := d.CollectionCounts()
+	if err != nil {
+		return err
+	}
+
+	counters := []struct {
+		name, help string
+		value      *uint64
+	}{
+		{"golangdb_writes_total", "Records written.", &d.metrics.writes},
+		{"golangdb_reads_total", "Records read by key, from the cache or disk.", &d.metrics.reads},
+		{"golangdb_deletes_total", "Records and collections deleted.", &d.metrics.deletes},
+		{"golangdb_written_bytes_total", "Encoded bytes of the records written.", &d.metrics.writtenBytes},
+		{"golangdb_read_bytes_total", "Bytes of record files read from disk.", &d.metrics.readBytes},
+	}
+	for _, c := range counters {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, atomic.LoadUint64(c.value)); err != nil {
+			return err
+		}
+	}
+
+	collections := make([]string, 0, len(counts))
+	for collection := range counts {
+		collections = append(collections, collection)
+	}
+	sort.Strings(collections)
+
+	if _, err := fmt.Fprint(w, "# HELP golangdb_records Records stored in a collection.\n# TYPE golangdb_records gauge\n"); err != nil {
+		return err
+	}
+	for _, collection := range collections {
+		if _, err := fmt.Fprintf(w, "golangdb_records{collection=\"%s\"} %d\n", labelEscaper.Replace(collection), counts[collection]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	db := newTestDriver(t, nil)
+	writeEmployees(t, db)
+
+	var u User
+	for _, name := range []string{"Eren", "Mikasa"} {
+		if err := db.Read("users", name, &u); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+	}
+	if err := db.Delete("users", "Johan"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := db.WriteMetrics(&buf); err != nil {
+		t.Fatalf("WriteMetrics: %v", err)
+	}
+	out := buf.String()
+
+	for _, line := range []string{
+		"# TYPE golangdb_writes_total counter",
+		"golangdb_writes_total 6",
+		"golangdb_reads_total 2",
+		"golangdb_deletes_total 1",
+		"# TYPE golangdb_records gauge",
+		`golangdb_records{collection="users"} 5`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("metrics are missing %q:\n%s", line, out)
+		}
+	}
+	if strings.Contains(out, "golangdb_written_bytes_total 0\n") || strings.Contains(out, "golangdb_read_bytes_total 0\n") {
+		t.Errorf("byte counters weren't updated:\n%s", out)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// QueryContext gives the function run by Query read access to the
+// collections Query locked. It can't be used once Query returns.
+type QueryContext struct {
+	d           *Driver
+	collections map[string]bool
+	done        bool
+}
+
+// Query locks the listed collections, always in the same order, and runs
+// fn with read access to them, so everything fn reads comes from one point
+// in time however its reads are spread. It returns what fn returns. Writes
+// to the collections wait until fn is done, so fn should be quick.
+func (d *Driver) Query(collections []string, fn func(q *QueryContext) (interface{}, error)) (interface{}, error) {
+	q := &QueryContext{d: d, collections: make(map[string]bool, len(collections))}
+	for _, collection := range collections {
+		if collection == "" {
+			return nil, fmt.Errorf("missing collection - no place to read records")
+		}
+		q.collections[collection] = true
+	}
+
+	unlock := d.lockCollections(collections)
+	defer unlock()
+	defer func() { q.done = true }()
+
+	return fn(q)
+}
+
+func (q *QueryContext) check(collection string) error {
+	if q.done {
+		return fmt.Errorf("query is over - unable to read %s", collection)
+	}
+	if !q.collections[collection] {
+		return fmt.Errorf("collection %s is not locked by the query", collection)
+	}
+	return nil
+}
+
+// Read decodes a record of one of the query's collections into v.
+func (q *QueryContext) Read(collection, resource string, v interface{}) error {
+	if err := q.check(collection); err != nil {
+		return err
+	}
+	if resource == "" {
+		return fmt.Errorf("missing resource - unable to read")
+	}
+	if err := q.d.checkResource(resource); err != nil {
+		return err
+	}
+
+	b, err := q.d.readRecordLocked(collection, resource)
+	if err != nil {
+		return err
+	}
+
+	return q.d.decodeRead(collection, resource, b, v)
+}
+
+// ReadAll returns every record of one of the query's collections, as
+// ReadAll does.
+func (q *QueryContext) ReadAll(collection string) ([]string, error) {
+	if err := q.check(collection); err != nil {
+		return nil, err
+	}
+
+	return q.d.readAll(collection)
+}
+
+// Keys returns the resource keys of one of the query's collections in name
+// order, or none if the collection doesn't exist.
+func (q *QueryContext) Keys(collection string) ([]string, error) {
+	if err := q.check(collection); err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	err := q.d.eachRecordFile(collection, func(resource, path string, fi os.FileInfo) error {
+		keys = append(keys, resource)
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+type order struct {
+	User  string
+	Total int
+}
+
+func TestQuery(t *testing.T) {
+	db := newTestDriver(t, nil)
+	writeEmployees(t, db)
+	for i, o := range []order{{"Eren", 10}, {"Mikasa", 20}, {"Eren", 5}} {
+		if err := db.Write("orders", strconv.Itoa(i), o); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	written := make(chan error, 1)
+	result, err := db.Query([]string{"users", "orders"}, func(q *QueryContext) (interface{}, error) {
+		keys, err := q.Keys("orders")
+		if err != nil {
+			return nil, err
+		}
+
+		// A concurrent write has to wait for the query to finish.
+		go func() {
+			written <- db.Write("orders", "3", order{"Mikasa", 100})
+		}()
+		time.Sleep(20 * time.Millisecond)
+
+		totals := make(map[string]int)
+		for _, key := range keys {
+			var o order
+			if err := q.Read("orders", key, &o); err != nil {
+				return nil, err
+			}
+			var u User
+			if err := q.Read("users", o.User, &u); err != nil {
+				return nil, err
+			}
+			totals[u.Company] += o.Total
+		}
+
+		if again, err := q.Keys("orders"); err != nil || len(again) != len(keys) {
+			t.Errorf("orders changed during the query: %v, %v", again, err)
+		}
+		if _, err := q.ReadAll("dogs"); err == nil {
+			t.Error("ReadAll of a collection outside the query succeeded")
+		}
+		return totals, nil
+	})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+
+	totals := result.(map[string]int)
+	if totals["Domini"] != 15 || totals["cedar"] != 20 || len(totals) != 2 {
+		t.Errorf("totals = %v, want Domini 15 and cedar 20", totals)
+	}
+
+	if err := <-written; err != nil {
+		t.Fatalf("concurrent Write: %v", err)
+	}
+	if n, err := db.EstimateCount("orders"); err != nil || n != 4 {
+		t.Errorf("orders after the query = %d, %v, want 4", n, err)
+	}
+}
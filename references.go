@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrReferenced is returned by Delete for a record that records of another
+// collection still refer to.
+var ErrReferenced = errors.New("record is still referenced")
+
+type reference struct {
+	from    string
+	field   string
+	cascade bool
+}
+
+// AddReference declares that field of records in fromCollection holds the
+// key of a record in toCollection, as a string or a number. Delete, and
+// every other way of deleting records such as DeleteAndReturn,
+// PruneOlderThan or deleting the whole collection, then refuses with
+// ErrReferenced to delete a record of toCollection that any record of
+// fromCollection refers to. A dotted field names a value inside nested
+// objects, as with indexes.
+func (d *Driver) AddReference(fromCollection, field, toCollection string) {
+	d.addReference(toCollection, reference{from: fromCollection, field: field})
+}
+
+// AddCascadingReference is AddReference, except that Delete also deletes
+// the records of fromCollection that refer to the deleted record instead
+// of refusing. The records it deletes that way have their own references
+// left unchecked.
+func (d *Driver) AddCascadingReference(fromCollection, field, toCollection string) {
+	d.addReference(toCollection, reference{from: fromCollection, field: field, cascade: true})
+}
+
+func (d *Driver) addReference(to string, ref reference) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.references[to] = append(d.references[to], ref)
+}
+
+func (d *Driver) referencesTo(collection string) []reference {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.references[collection]
+}
+
+// lockDelete locks the collections and every collection referring to
+// them, as deleteLocked needs, and returns a function unlocking them.
+func (d *Driver) lockDelete(collections ...string) func() {
+	locked := append([]string(nil), collections...)
+	for _, collection := range collections {
+		for _, ref := range d.referencesTo(collection) {
+			locked = append(locked, ref.from)
+		}
+	}
+
+	return d.lockCollections(locked)
+}
+
+// deleteReferenced deletes a record, or the whole collection when resource
+// is empty, of a collection other collections refer to, first failing if a
+// plain reference to it remains and then deleting the records that cascade
+// from it. The caller must hold the mutexes of the collection and of every
+// collection in refs.
+func (d *Driver) deleteReferenced(collection, resource string, refs []reference) error {
+	referenced := collection
+	var keys []string
+	if resource != "" {
+		keys = []string{strings.TrimSuffix(resource, d.codec.Ext())}
+		referenced += "/" + keys[0]
+	} else {
+		err := d.eachRecordFile(collection, func(resource, path string, fi os.FileInfo) error {
+			keys = append(keys, resource)
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	dependents := make([][]string, len(refs))
+	for i, ref := range refs {
+		// Records of the collection itself go with it.
+		if resource == "" && ref.from == collection {
+			continue
+		}
+
+		var err error
+		if dependents[i], err = d.referrers(ref, keys); err != nil {
+			return err
+		}
+		if len(dependents[i]) > 0 && !ref.cascade {
+			return fmt.Errorf("%w: %s by %s/%s", ErrReferenced, referenced, ref.from, dependents[i][0])
+		}
+	}
+
+	for i, ref := range refs {
+		for _, dependent := range dependents[i] {
+			if err := d.removeLocked(ref.from, dependent); err != nil {
+				return err
+			}
+		}
+	}
+
+	return d.removeLocked(collection, resource)
+}
+
+// referrers returns the records of ref.from whose ref.field holds one of
+// keys.
+func (d *Driver) referrers(ref reference, keys []string) ([]string, error) {
+	values := make(map[string]bool, 2*len(keys))
+	for _, key := range keys {
+		quoted, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		values[key], values[string(quoted)] = true, true
+	}
+
+	var found []string
+	err := d.eachRecord(ref.from, func(resource string, b []byte) error {
+		if v, ok := fieldValue(d.indexDoc(ref.from, b), ref.field); ok && values[v] {
+			found = append(found, resource)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return found, err
+}
+
+// lockCollections locks each of the collections' mutexes once, in an order
+// every caller shares, and returns a function unlocking them. Collections
+// sharing a stripe under MutexStripes only lock it once.
+func (d *Driver) lockCollections(collections []string) func() {
+	if d.stripes != nil {
+		var stripes []int
+		seen := make(map[int]bool)
+		for _, collection := range collections {
+			h := fnv.New32a()
+			h.Write([]byte(collection))
+			if i := int(h.Sum32() % uint32(len(d.stripes))); !seen[i] {
+				seen[i] = true
+				stripes = append(stripes, i)
+			}
+		}
+		sort.Ints(stripes)
+
+		for _, i := range stripes {
+			d.stripes[i].Lock()
+		}
+		return func() {
+			for _, i := range stripes {
+				d.stripes[i].Unlock()
+			}
+		}
+	}
+
+	names := append([]string(nil), collections...)
+	sort.Strings(names)
+
+	var held []*sync.Mutex
+	for i, collection := range names {
+		if i > 0 && collection == names[i-1] {
+			continue
+		}
+		held = append(held, d.lockCollection(collection))
+	}
+	return func() {
+		for _, m := range held {
+			m.Unlock()
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type employee struct {
+	Name    string
+	Company string
+}
+
+func TestAddReferenceBlocksDelete(t *testing.T) {
+	db := newTestDriver(t, &Options{MutexStripes: 4})
+	db.AddReference("employees", "Company", "companies")
+
+	for _, name := range []string{"Google", "Fidelity"} {
+		if err := db.Write("companies", name, map[string]string{"Name": name}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := db.Write("employees", "Johan", employee{Name: "Johan", Company: "Google"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if err := db.Delete("companies", "Google"); !errors.Is(err, ErrReferenced) {
+		t.Fatalf("Delete of a referenced company = %v, want ErrReferenced", err)
+	}
+	if _, err := os.Stat(filepath.Join(db.Dir(), "companies", "Google.json")); err != nil {
+		t.Errorf("referenced company was deleted: %v", err)
+	}
+
+	if err := db.Delete("companies", "Fidelity"); err != nil {
+		t.Errorf("Delete of an unreferenced company: %v", err)
+	}
+
+	if err := db.Delete("employees", "Johan"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := db.Delete("companies", "Google"); err != nil {
+		t.Errorf("Delete once the reference is gone: %v", err)
+	}
+}
+
+func TestAddCascadingReference(t *testing.T) {
+	db := newTestDriver(t, nil)
+	db.AddCascadingReference("employees", "Company", "companies")
+
+	if err := db.Write("companies", "Google", map[string]string{"Name": "Google"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	for _, e := range []employee{{"Johan", "Google"}, {"Mikasa", "Google"}, {"Erwin", "Fidelity"}} {
+		if err := db.Write("employees", e.Name, e); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	if err := db.Delete("companies", "Google"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	keys, err := db.KeysByModTime("employees", false)
+	if err != nil {
+		t.Fatalf("KeysByModTime: %v", err)
+	}
+	if len(keys) != 1 || keys[0] != "Erwin" {
+		t.Errorf("employees left = %v, want only Erwin", keys)
+	}
+}
+
+func TestReferencesGuardEveryDelete(t *testing.T) {
+	db := newTestDriver(t, nil)
+	db.AddReference("employees", "Company", "companies")
+
+	if err := db.Write("companies", "Google", map[string]string{"Name": "Google"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := db.Write("employees", "Johan", employee{Name: "Johan", Company: "Google"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	var company map[string]string
+	if err := db.DeleteAndReturn("companies", "Google", &company); !errors.Is(err, ErrReferenced) {
+		t.Errorf("DeleteAndReturn of a referenced company = %v, want ErrReferenced", err)
+	}
+	if err := db.Delete("companies", ""); !errors.Is(err, ErrReferenced) {
+		t.Errorf("Delete of a referenced collection = %v, want ErrReferenced", err)
+	}
+	if _, err := os.Stat(filepath.Join(db.Dir(), "companies", "Google.json")); err != nil {
+		t.Errorf("referenced company was deleted: %v", err)
+	}
+
+	if err := db.Delete("employees", "Johan"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := db.Delete("companies", ""); err != nil {
+		t.Errorf("Delete of the collection once the reference is gone: %v", err)
+	}
+}
+
+func TestCascadingReferenceOnCollectionDelete(t *testing.T) {
+	db := newTestDriver(t, nil)
+	db.AddCascadingReference("employees", "Company", "companies")
+
+	for _, name := range []string{"Google", "Fidelity"} {
+		if err := db.Write("companies", name, map[string]string{"Name": name}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	for _, e := range []employee{{"Johan", "Google"}, {"Mikasa", "Fidelity"}, {"Erwin", "Marley"}} {
+		if err := db.Write("employees", e.Name, e); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	if err := db.Delete("companies", ""); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	keys, err := db.KeysByModTime("employees", false)
+	if err != nil {
+		t.Fatalf("KeysByModTime: %v", err)
+	}
+	if len(keys) != 1 || keys[0] != "Erwin" {
+		t.Errorf("employees left = %v, want only Erwin", keys)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrSchemaViolation is returned by writes whose record doesn't match the
+// schema set for its collection.
+var ErrSchemaViolation = errors.New("record violates the collection's schema")
+
+// Schema lists the top-level fields every record of a collection must
+// hold, with their JSON type as InferSchema reports it. An empty type or
+// "mixed" accepts any value.
+type Schema map[string]string
+
+// SetDefaults makes Write, WriteBatch and the other encoding writes fill
+// in these top-level fields in records of the collection that leave them
+// out. Defaults are applied before the collection's schema is checked. A
+// nil map removes them. Only JSON records can be given defaults.
+func (d *Driver) SetDefaults(collection string, defaults map[string]interface{}) error {
+	if defaults == nil {
+		d.mutex.Lock()
+		delete(d.recordDefaults, collection)
+		d.mutex.Unlock()
+		return nil
+	}
+
+	// Round trip the defaults so they hold the same types, such as
+	// json.Number, as the records they are merged into.
+	b, err := json.Marshal(defaults)
+	if err != nil {
+		return fmt.Errorf("unable to encode defaults for %s: %w", collection, err)
+	}
+	var doc map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.recordDefaults[collection] = doc
+	return nil
+}
+
+// SetSchema makes the encoding writes reject records of the collection
+// that don't match schema with ErrSchemaViolation. A nil schema removes
+// it. Only JSON records can be checked.
+func (d *Driver) SetSchema(collection string, schema Schema) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if schema == nil {
+		delete(d.schemas, collection)
+		return
+	}
+
+	d.schemas[collection] = schema
+}
+
+// applySchema fills in the collection's defaults and checks its schema
+// against encoded record bytes, returning them re-encoded if defaults were
+// added.
+func (d *Driver) applySchema(collection, resource string, b []byte) ([]byte, error) {
+	d.mutex.Lock()
+	defaults, schema := d.recordDefaults[collection], d.schemas[collection]
+	d.mutex.Unlock()
+
+	if defaults == nil && schema == nil {
+		return b, nil
+	}
+	if _, ok := d.codec.(JSONCodec); !ok {
+		return nil, fmt.Errorf("unable to apply the schema of %s - records stored with %T can't be inspected as JSON", collection, d.codec)
+	}
+
+	doc := d.indexDoc(collection, b)
+	if doc == nil {
+		return nil, fmt.Errorf("%w: %s/%s is not a JSON object", ErrSchemaViolation, collection, resource)
+	}
+
+	added := false
+	for field, v := range defaults {
+		if _, ok := doc[field]; !ok {
+			doc[field] = v
+			added = true
+		}
+	}
+
+	fields := make([]string, 0, len(schema))
+	for field := range schema {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		v, ok := doc[field]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s/%s has no %s", ErrSchemaViolation, collection, resource, field)
+		}
+		if want := schema[field]; want != "" && want != "mixed" && jsonType(v) != want {
+			return nil, fmt.Errorf("%w: %s/%s field %s is %s, not %s", ErrSchemaViolation, collection, resource, field, jsonType(v), want)
+		}
+	}
+
+	if !added {
+		return b, nil
+	}
+
+	return d.encode(collection, doc)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSchemaWithDefaults(t *testing.T) {
+	db := newTestDriver(t, nil)
+	if err := db.SetDefaults("users", map[string]interface{}{"Company": "Survey Corps", "Age": 15}); err != nil {
+		t.Fatalf("SetDefaults: %v", err)
+	}
+	db.SetSchema("users", Schema{"Name": "string", "Company": "string", "Age": "number"})
+
+	// Company and Age are left out, and only pass once defaulted.
+	if err := db.Write("users", "Eren", map[string]string{"Name": "Eren"}); err != nil {
+		t.Fatalf("Write with defaulted fields: %v", err)
+	}
+	var u User
+	if err := db.Read("users", "Eren", &u); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if u.Company != "Survey Corps" || u.Age != "15" {
+		t.Errorf("Read = %+v, want the defaults filled in", u)
+	}
+
+	// A field that is present keeps its own value and is still checked.
+	err := db.Write("users", "Levi", map[string]interface{}{"Name": "Levi", "Age": "old"})
+	if !errors.Is(err, ErrSchemaViolation) {
+		t.Errorf("Write with a string Age = %v, want ErrSchemaViolation", err)
+	}
+	if err := db.Write("users", "Levi", []string{"Levi"}); !errors.Is(err, ErrSchemaViolation) {
+		t.Errorf("Write of an array = %v, want ErrSchemaViolation", err)
+	}
+
+	db.SetSchema("users", nil)
+	if err := db.Write("users", "Levi", map[string]interface{}{"Name": "Levi", "Age": "old"}); err != nil {
+		t.Errorf("Write after removing the schema: %v", err)
+	}
+}
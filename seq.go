@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// seqFile holds, inside a collection's directory, the collection's
+// sequence counter.
+const seqFile = "_seq.json"
+
+// NextSeq increments the collection's sequence counter and returns the new
+// value, starting from 1. The counter is saved before NextSeq returns, so
+// it carries on from where it was when the database is reopened.
+func (d *Driver) NextSeq(collection string) (uint64, error) {
+	if collection == "" {
+		return 0, fmt.Errorf("missing collection - no place to keep a sequence")
+	}
+
+	return timed(d, func() (uint64, error) {
+		mutex := d.lockCollection(collection)
+		defer mutex.Unlock()
+
+		if err := d.checkWritable(); err != nil {
+			return 0, err
+		}
+
+		seq, err := d.currentSeq(collection)
+		if err != nil {
+			return 0, err
+		}
+		seq++
+
+		b, err := marshal(map[string]uint64{"seq": seq})
+		if err != nil {
+			return 0, err
+		}
+
+		dir := filepath.Join(d.Dir(), collection)
+		if err := os.MkdirAll(dir, d.dirMode()); err != nil {
+			return 0, err
+		}
+		if err := d.writeFile(filepath.Join(dir, seqFile), b); err != nil {
+			return 0, err
+		}
+		if d.durable {
+			if err := syncDir(dir); err != nil {
+				return 0, err
+			}
+		}
+
+		return seq, nil
+	})
+}
+
+// CurrentSeq returns the value NextSeq last returned for the collection,
+// or 0 if it has never been called.
+func (d *Driver) CurrentSeq(collection string) (uint64, error) {
+	if collection == "" {
+		return 0, fmt.Errorf("missing collection - no place to keep a sequence")
+	}
+
+	return timed(d, func() (uint64, error) {
+		mutex := d.lockCollection(collection)
+		defer mutex.Unlock()
+
+		return d.currentSeq(collection)
+	})
+}
+
+func (d *Driver) currentSeq(collection string) (uint64, error) {
+	b, err := ioutil.ReadFile(filepath.Join(d.Dir(), collection, seqFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var state struct {
+		Seq uint64 `json:"seq"`
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return 0, fmt.Errorf("unable to read %s of %s: %w", seqFile, collection, err)
+	}
+
+	return state.Seq, nil
+}
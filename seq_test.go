@@ -0,0 +1,43 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSeqSurvivesRestart(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db")
+
+	db, err := New(dir, nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if seq, err := db.CurrentSeq("orders"); err != nil || seq != 0 {
+		t.Errorf("CurrentSeq before NextSeq = %d, %v, want 0", seq, err)
+	}
+	for want := uint64(1); want <= 3; want++ {
+		if seq, err := db.NextSeq("orders"); err != nil || seq != want {
+			t.Fatalf("NextSeq = %d, %v, want %d", seq, err, want)
+		}
+	}
+	if err := db.Write("orders", "1", map[string]int{"id": 1}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if records, err := db.ReadAll("orders"); err != nil || len(records) != 1 {
+		t.Errorf("ReadAll = %v, %v, want only the record", records, err)
+	}
+
+	reopened, err := New(dir, nil)
+	if err != nil {
+		t.Fatalf("New after restart: %v", err)
+	}
+	if seq, err := reopened.CurrentSeq("orders"); err != nil || seq != 3 {
+		t.Errorf("CurrentSeq after restart = %d, %v, want 3", seq, err)
+	}
+	if seq, err := reopened.NextSeq("orders"); err != nil || seq != 4 {
+		t.Errorf("NextSeq after restart = %d, %v, want 4", seq, err)
+	}
+	if seq, err := reopened.CurrentSeq("users"); err != nil || seq != 0 {
+		t.Errorf("CurrentSeq of another collection = %d, %v, want 0", seq, err)
+	}
+}
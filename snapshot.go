@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Snapshot is a frozen, read-only view of a database, returned by
+// OpenSnapshot. Later writes to the database don't show through it.
+type Snapshot struct {
+	db  *Driver
+	dir string
+}
+
+// OpenSnapshot hard links every record file into a new snapshot directory
+// in Dir while the whole database is locked. Writes replace record files
+// rather than changing them in place, so the links keep the contents they
+// had. The database directory must be on a filesystem that supports hard
+// links. Close removes the snapshot.
+func (d *Driver) OpenSnapshot() (*Snapshot, error) {
+	unlock := d.lockAll()
+	defer unlock()
+
+	collections, err := d.collections()
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir(d.Dir(), "snapshot-*"+snapshotSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, collection := range collections {
+		from := filepath.Join(d.Dir(), collection)
+		err := d.eachRecordFile(collection, func(resource, path string, fi os.FileInfo) error {
+			rel, err := filepath.Rel(from, path)
+			if err != nil {
+				return err
+			}
+
+			link := filepath.Join(dir, collection, rel)
+			if err := os.MkdirAll(filepath.Dir(link), d.dirMode()); err != nil {
+				return err
+			}
+			return os.Link(path, link)
+		})
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+	}
+
+	db, err := New(dir, &Options{
+		Logger:           d.log,
+		Codec:            d.codec,
+		HierarchicalKeys: d.hierarchical,
+		ReadOnly:         true,
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	// lockAll holds d.mutex, which guards the field maps.
+	for collection, mapping := range d.fieldMaps {
+		db.fieldMaps[collection] = mapping
+	}
+
+	return &Snapshot{db: db, dir: dir}, nil
+}
+
+// Read decodes a record as it was when the snapshot was taken.
+func (s *Snapshot) Read(collection, resource string, v interface{}) error {
+	return s.db.Read(collection, resource, v)
+}
+
+// ReadAll returns a collection's records as they were when the snapshot
+// was taken.
+func (s *Snapshot) ReadAll(collection string) ([]string, error) {
+	return s.db.ReadAll(collection)
+}
+
+// Keys returns the resource keys the collection held when the snapshot was
+// taken, in name order.
+func (s *Snapshot) Keys(collection string) ([]string, error) {
+	var keys []string
+	err := s.db.eachRecordFile(collection, func(resource, path string, fi os.FileInfo) error {
+		keys = append(keys, resource)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Close removes the snapshot's directory. The Snapshot can't be read from
+// afterwards.
+func (s *Snapshot) Close() error {
+	return os.RemoveAll(s.dir)
+}
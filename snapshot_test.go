@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOpenSnapshot(t *testing.T) {
+	db := newTestDriver(t, &Options{CompressOverBytes: 100})
+	writeEmployees(t, db)
+
+	snapshot, err := db.OpenSnapshot()
+	if err != nil {
+		t.Fatalf("OpenSnapshot: %v", err)
+	}
+
+	if err := db.Write("users", "Eren", User{Name: "Eren", Age: "99"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := db.Write("users", "Levi", User{Name: "Levi"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := db.Delete("users", "Mikasa"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	var u User
+	if err := snapshot.Read("users", "Eren", &u); err != nil || u.Age != "29" {
+		t.Errorf("snapshot Read Eren = %+v, %v, want Age 29", u, err)
+	}
+	if err := snapshot.Read("users", "Mikasa", &u); err != nil || u.Name != "Mikasa" {
+		t.Errorf("snapshot Read Mikasa = %+v, %v, want the deleted record", u, err)
+	}
+
+	keys, err := snapshot.Keys("users")
+	if err != nil {
+		t.Fatalf("Keys: %v", err)
+	}
+	if want := []string{"Eren", "Erwin", "Johan", "Maximilian", "Mikasa", "Reiner"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("snapshot Keys = %v, want %v", keys, want)
+	}
+	if records, err := snapshot.ReadAll("users"); err != nil || len(records) != 6 {
+		t.Errorf("snapshot ReadAll = %d records, %v, want 6", len(records), err)
+	}
+
+	// The snapshot isn't a collection of the live database.
+	if keys, err := db.KeySizes("users"); err != nil || len(keys) != 6 {
+		t.Errorf("live users = %v, %v", keys, err)
+	}
+	counts, err := db.CollectionCounts()
+	if err != nil || len(counts) != 1 {
+		t.Errorf("live CollectionCounts = %v, %v, want only users", counts, err)
+	}
+
+	if err := snapshot.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if recovery, leftovers, err := db.NeedsRecovery(); err != nil || recovery {
+		t.Errorf("NeedsRecovery after Close = %v, %v, %v", recovery, leftovers, err)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// storage is what the Driver reads record files through. It lets tests
+// stand in for a slow or stuck filesystem.
+type storage interface {
+	ReadFile(name string) ([]byte, error)
+}
+
+// writeStorage is implemented by storages that also create the temp files
+// writes go through, letting tests stand in for a full disk. Storages that
+// don't implement it write to the local filesystem.
+type writeStorage interface {
+	OpenFile(name string, flag int, perm os.FileMode) (writableFile, error)
+}
+
+// writableFile is the part of *os.File writeFile uses.
+type writableFile interface {
+	Write(b []byte) (int, error)
+	Sync() error
+	Close() error
+}
+
+// osStorage reads straight from the local filesystem. It is the default.
+type osStorage struct{}
+
+func (osStorage) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(name)
+}
+
+func (osStorage) OpenFile(name string, flag int, perm os.FileMode) (writableFile, error) {
+	return os.OpenFile(name, flag, perm)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// recordWriter streams a record into its temp file and moves it into place
+// when closed. It holds the collection's mutex for its whole lifetime.
+type recordWriter struct {
+	d          *Driver
+	f          *os.File
+	collection string
+	resource   string
+	path       string
+	unlock     func()
+	closed     bool
+}
+
+// WriteStream returns a writer for building a large record without holding
+// it in memory. Bytes written must already be in the form the codec stores
+// and are not passed through Transform, field mapping or compression.
+// Close checks that a JSON record is well formed, then atomically moves it
+// into place; nothing is visible to readers before that. The collection
+// stays locked until Close is called, so the writer must always be closed.
+func (d *Driver) WriteStream(collection, resource string) (io.WriteCloser, error) {
+	if collection == "" {
+		return nil, fmt.Errorf("missing collection - no place to save record")
+	}
+	if resource == "" {
+		return nil, fmt.Errorf("missing resource - unable to save")
+	}
+	if err := d.checkResource(resource); err != nil {
+		return nil, err
+	}
+	if err := d.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	mutex := d.lockCollection(collection)
+
+	path := d.recordPath(collection, resource)
+	if err := os.MkdirAll(filepath.Dir(path), d.dirMode()); err != nil {
+		mutex.Unlock()
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, d.fileMode())
+	if err != nil {
+		mutex.Unlock()
+		return nil, err
+	}
+
+	return &recordWriter{
+		d:          d,
+		f:          f,
+		collection: collection,
+		resource:   resource,
+		path:       path,
+		unlock:     mutex.Unlock,
+	}, nil
+}
+
+func (w *recordWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+
+	return w.f.Write(p)
+}
+
+func (w *recordWriter) Close() error {
+	if w.closed {
+		return os.ErrClosed
+	}
+	w.closed = true
+	defer w.unlock()
+
+	tempPath := w.f.Name()
+	if err := w.finish(); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	return nil
+}
+
+func (w *recordWriter) finish() error {
+	d := w.d
+
+	if d.durable {
+		if err := w.f.Sync(); err != nil {
+			w.f.Close()
+			return err
+		}
+	}
+
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+
+	if _, ok := d.codec.(JSONCodec); ok {
+		if err := validJSONFile(w.f.Name()); err != nil {
+			return fmt.Errorf("invalid record %s/%s: %w", w.collection, w.resource, err)
+		}
+	}
+
+	// Indexes and the change log need the record's contents, so only then
+	// is it read back into memory.
+	var b []byte
+	var doc map[string]interface{}
+	if d.changeLog || len(d.collectionIndexes(w.collection)) > 0 {
+		var err error
+		if b, err = ioutil.ReadFile(w.f.Name()); err != nil {
+			return err
+		}
+
+		if doc, err = d.checkIndexes(w.collection, w.resource, b); err != nil {
+			return err
+		}
+	}
+
+	if d.detectCase {
+		if err := checkCaseCollision(w.path); err != nil {
+			return err
+		}
+	}
+	if d.keepBackup {
+		if err := backupRecord(w.path); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(w.f.Name(), w.path); err != nil {
+		return err
+	}
+	if err := os.Remove(w.path + compressedExt); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	d.updateIndexes(w.collection, w.resource, doc)
+	d.cache.remove(w.collection, w.resource)
+	d.notify(OpWrite, w.collection, w.resource)
+	d.bumpVersion(w.collection)
+
+	if err := d.logChange(OpWrite, w.collection, w.resource, b); err != nil {
+		return err
+	}
+
+	if d.durable {
+		return syncDir(filepath.Dir(w.path))
+	}
+
+	return nil
+}
+
+// validJSONFile checks that a file holds exactly one JSON value, reading it
+// token by token so large files are never held in memory.
+func validJSONFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+
+		if depth == 0 {
+			break
+		}
+	}
+
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("unexpected data after the record")
+	}
+
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteStream(t *testing.T) {
+	db := newTestDriver(t, nil)
+
+	w, err := db.WriteStream("logs", "big")
+	if err != nil {
+		t.Fatalf("WriteStream: %v", err)
+	}
+
+	const n = 20000
+	io.WriteString(w, "[")
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			io.WriteString(w, ",")
+		}
+		if _, err := fmt.Fprintf(w, `{"seq": %d}`, i); err != nil {
+			t.Fatalf("writing item %d: %v", i, err)
+		}
+	}
+	io.WriteString(w, "]")
+
+	if _, err := os.Stat(filepath.Join(db.Dir(), "logs", "big.json")); !os.IsNotExist(err) {
+		t.Errorf("record visible before Close: %v", err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := w.Close(); err == nil {
+		t.Error("second Close succeeded")
+	}
+
+	var items []struct{ Seq int }
+	if err := db.Read("logs", "big", &items); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if len(items) != n || items[n-1].Seq != n-1 {
+		t.Errorf("read back %d items, want %d", len(items), n)
+	}
+}
+
+func TestWriteStreamRejectsInvalidJSON(t *testing.T) {
+	db := newTestDriver(t, nil)
+
+	w, err := db.WriteStream("logs", "broken")
+	if err != nil {
+		t.Fatalf("WriteStream: %v", err)
+	}
+	io.WriteString(w, `{"seq": 1`)
+
+	if err := w.Close(); err == nil {
+		t.Fatal("Close accepted a truncated record")
+	}
+
+	files, err := os.ReadDir(filepath.Join(db.Dir(), "logs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("files left behind: %v", files)
+	}
+
+	if err := db.Write("logs", "other", []int{1}); err != nil {
+		t.Errorf("Write after a failed stream: %v", err)
+	}
+}
+
+func TestWriteStreamKeepsBackup(t *testing.T) {
+	db := newTestDriver(t, &Options{KeepBackup: true})
+
+	if err := db.Write("users", "Eren", User{Name: "Eren", Company: "Survey Corps"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	w, err := db.WriteStream("users", "Eren")
+	if err != nil {
+		t.Fatalf("WriteStream: %v", err)
+	}
+	io.WriteString(w, `{"Name": "Eren", "Company": "Marley"}`)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if err := db.Rollback("users", "Eren"); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+	var u User
+	if err := db.Read("users", "Eren", &u); err != nil || u.Company != "Survey Corps" {
+		t.Errorf("Read after Rollback = %+v, %v, want the version before the stream", u, err)
+	}
+}
+
+func TestWriteStreamDetectsCaseCollision(t *testing.T) {
+	db := newTestDriver(t, &Options{DetectCaseCollision: true})
+
+	if err := db.Write("users", "eren", User{Name: "eren"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	w, err := db.WriteStream("users", "Eren")
+	if err != nil {
+		t.Fatalf("WriteStream: %v", err)
+	}
+	io.WriteString(w, `{"Name": "Eren"}`)
+	if err := w.Close(); !errors.Is(err, ErrCaseCollision) {
+		t.Errorf("Close = %v, want ErrCaseCollision", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(db.Dir(), "users", "Eren.json")); !os.IsNotExist(err) {
+		t.Errorf("colliding record was stored: %v", err)
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+)
+
+// DecodeErrorHandler is consulted when a record can't be decoded into the
+// requested type. It returns a replacement value to use in place of the
+// record, nil to skip the record, or an error to abort the whole read. A
+// replacement must be of the requested type or a pointer to it.
+type DecodeErrorHandler func(collection, resource string, data []byte, err error) (interface{}, error)
+
+// FailOnDecodeError aborts the read with the decode error.
+func FailOnDecodeError(collection, resource string, data []byte, err error) (interface{}, error) {
+	return nil, fmt.Errorf("unable to decode %s/%s: %w", collection, resource, err)
+}
+
+// SkipOnDecodeError leaves records that can't be decoded out of the result.
+func SkipOnDecodeError(collection, resource string, data []byte, err error) (interface{}, error) {
+	return nil, nil
+}
+
+// ReadTyped reads a single record into a T, starting from the value
+// registered with RegisterDefaults, if any.
+func ReadTyped[T any](d *Driver, collection, resource string) (T, error) {
+	v := typedDefault[T](d)
+	err := d.Read(collection, resource, &v)
+	return v, err
+}
+
+// RegisterDefaults makes the typed readers start every T they decode from
+// the value provider returns, so fields a record leaves out keep the
+// provider's values instead of their zero values.
+func RegisterDefaults[T any](d *Driver, provider func() T) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.defaults[reflect.TypeOf((*T)(nil)).Elem()] = provider
+}
+
+// typedDefault returns the registered default T, or T's zero value.
+func typedDefault[T any](d *Driver) T {
+	d.mutex.Lock()
+	provider, ok := d.defaults[reflect.TypeOf((*T)(nil)).Elem()].(func() T)
+	d.mutex.Unlock()
+
+	var v T
+	if ok {
+		v = provider()
+	}
+	return v
+}
+
+// ReadAllTyped decodes every record in the collection into a T.
+func ReadAllTyped[T any](d *Driver, collection string) ([]T, error) {
+	return Find(d, collection, func(T) bool { return true })
+}
+
+// Find returns the records in the collection for which pred returns true.
+func Find[T any](d *Driver, collection string, pred func(T) bool) ([]T, error) {
+	var records []T
+	err := ForEach(d, collection, func(resource string, v T) error {
+		if pred(v) {
+			records = append(records, v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// CountWhere returns how many records in the collection satisfy pred,
+// decoding them one at a time without keeping the matches.
+func CountWhere[T any](d *Driver, collection string, pred func(T) bool) (int, error) {
+	n := 0
+	err := ForEach(d, collection, func(resource string, v T) error {
+		if pred(v) {
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// CardinalityOf returns how many distinct values extract returns across the
+// records in the collection. Only the distinct values are kept in memory.
+func CardinalityOf[T any](d *Driver, collection string, extract func(T) string) (int, error) {
+	seen := make(map[string]struct{})
+	err := ForEach(d, collection, func(resource string, v T) error {
+		seen[extract(v)] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(seen), nil
+}
+
+// ForEach decodes the records in the collection one at a time and calls fn
+// with each of them. Returning an error from fn stops the iteration.
+func ForEach[T any](d *Driver, collection string, fn func(resource string, v T) error) error {
+	return d.eachRecord(collection, func(resource string, b []byte) error {
+		v, ok, err := decodeTyped[T](d, collection, resource, b)
+		if err != nil || !ok {
+			return err
+		}
+
+		return fn(resource, v)
+	})
+}
+
+// decodeTyped decodes b into a T, falling back to the configured
+// DecodeErrorHandler. ok is false when the record should be skipped.
+func decodeTyped[T any](d *Driver, collection, resource string, b []byte) (v T, ok bool, err error) {
+	v = typedDefault[T](d)
+	decodeErr := d.decodeRead(collection, resource, b, &v)
+	if decodeErr == nil {
+		return v, true, nil
+	}
+
+	replacement, err := d.onDecodeError(collection, resource, b, decodeErr)
+	if err != nil || replacement == nil {
+		return v, false, err
+	}
+
+	switch r := replacement.(type) {
+	case T:
+		return r, true, nil
+	case *T:
+		return *r, true, nil
+	}
+
+	return v, false, fmt.Errorf("replacement for %s/%s is %T, not %T", collection, resource, replacement, v)
+}
+
+// TypedIterator yields the records of a Stream one at a time.
+type TypedIterator[T any] struct {
+	d          *Driver
+	collection string
+	pred       func(T) bool
+	files      []streamFile
+	resource   string
+	value      T
+	err        error
+}
+
+type streamFile struct {
+	resource, path string
+}
+
+// Stream returns an iterator over the records in the collection for which
+// pred returns true, decoded into a T. The collection's file names are
+// listed up front but each record is only read and decoded when Next gets
+// to it; records deleted in the meantime are skipped.
+func Stream[T any](d *Driver, collection string, pred func(T) bool) (*TypedIterator[T], error) {
+	it := &TypedIterator[T]{d: d, collection: collection, pred: pred}
+
+	err := d.eachRecordFile(collection, func(resource, path string, fi os.FileInfo) error {
+		it.files = append(it.files, streamFile{resource, path})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return it, nil
+}
+
+// Next advances to the next matching record, reporting false once there
+// are none left or an error stopped the iteration.
+func (it *TypedIterator[T]) Next() bool {
+	for it.err == nil && len(it.files) > 0 {
+		f := it.files[0]
+		it.files = it.files[1:]
+
+		b, err := it.d.readRecordFile(f.path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			it.err = err
+			return false
+		}
+
+		v, ok, err := decodeTyped[T](it.d, it.collection, f.resource, b)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if ok && it.pred(v) {
+			it.resource, it.value = f.resource, v
+			return true
+		}
+	}
+
+	return false
+}
+
+// Value returns the record Next advanced to.
+func (it *TypedIterator[T]) Value() T {
+	return it.value
+}
+
+// Resource returns the key of the record Next advanced to.
+func (it *TypedIterator[T]) Resource() string {
+	return it.resource
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *TypedIterator[T]) Err() error {
+	return it.err
+}
+
+// ReadAllChan decodes the records in the collection on a single goroutine
+// and sends them on the returned channel, which is closed once they have
+// all been sent or an error stops the read. The error, if any, is then
+// sent on the error channel, which is closed too. The records must be
+// received until the channel is closed, or the goroutine is left blocked.
+func ReadAllChan[T any](d *Driver, collection string) (<-chan T, <-chan error) {
+	records := make(chan T)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(errs)
+		defer close(records)
+
+		it, err := Stream(d, collection, func(T) bool { return true })
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		for it.Next() {
+			records <- it.Value()
+		}
+		if err := it.Err(); err != nil {
+			errs <- err
+		}
+	}()
+
+	return records, errs
+}
+
+type registeredType struct {
+	typ     reflect.Type
+	pointer bool
+}
+
+// RegisterType tells ReadAllPolymorphic to decode records of the collection
+// whose "_type" field equals typeName into the type of proto. Registering a
+// pointer makes ReadAllPolymorphic return pointers.
+func (d *Driver) RegisterType(collection, typeName string, proto interface{}) {
+	rt := registeredType{typ: reflect.TypeOf(proto)}
+	if rt.typ.Kind() == reflect.Ptr {
+		rt.typ, rt.pointer = rt.typ.Elem(), true
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.types[collection] == nil {
+		d.types[collection] = make(map[string]registeredType)
+	}
+	d.types[collection][typeName] = rt
+}
+
+// ReadAllPolymorphic decodes every record in a collection holding mixed
+// record types into the type registered for its "_type" field. Records
+// with an unregistered type, or that fail to decode, are handed to the
+// configured DecodeErrorHandler, and any replacement it returns is used as
+// is.
+func (d *Driver) ReadAllPolymorphic(collection string) ([]interface{}, error) {
+	d.mutex.Lock()
+	types := d.types[collection]
+	d.mutex.Unlock()
+
+	var records []interface{}
+	err := d.eachRecord(collection, func(resource string, b []byte) error {
+		v, err := d.decodePolymorphic(collection, resource, b, types)
+		if err != nil {
+			if v, err = d.onDecodeError(collection, resource, b, err); err != nil {
+				return err
+			}
+		}
+
+		if v != nil {
+			records = append(records, v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+func (d *Driver) decodePolymorphic(collection, resource string, b []byte, types map[string]registeredType) (interface{}, error) {
+	var tag struct {
+		Type string `json:"_type"`
+	}
+	if err := d.decode(collection, b, &tag); err != nil {
+		return nil, err
+	}
+
+	rt, ok := types[tag.Type]
+	if !ok {
+		return nil, fmt.Errorf("no type registered for _type %q", tag.Type)
+	}
+
+	ptr := reflect.New(rt.typ)
+	if err := d.decodeRead(collection, resource, b, ptr.Interface()); err != nil {
+		return nil, err
+	}
+
+	if rt.pointer {
+		return ptr.Interface(), nil
+	}
+	return ptr.Elem().Interface(), nil
+}
+
+// errSampled stops a walk over a collection once enough records were seen.
+var errSampled = errors.New("sample complete")
+
+// InferSchema guesses the shape of a collection's records from up to
+// sampleSize of them, or all of them if sampleSize isn't positive. It
+// returns the top-level fields seen in any record with their JSON type:
+// "string", "number", "bool", "object", "array" or "null". A field whose
+// type differs between records is reported as "mixed", except that null
+// gives way to any other type. Records that aren't objects are ignored.
+func (d *Driver) InferSchema(collection string, sampleSize int) (map[string]string, error) {
+	if _, ok := d.codec.(JSONCodec); !ok {
+		return nil, fmt.Errorf("unable to infer a schema - records stored with %T can't be inspected as JSON", d.codec)
+	}
+
+	schema := make(map[string]string)
+	seen := 0
+	err := d.eachRecord(collection, func(resource string, b []byte) error {
+		if sampleSize > 0 && seen == sampleSize {
+			return errSampled
+		}
+		seen++
+
+		for field, v := range d.indexDoc(collection, b) {
+			schema[field] = mergeType(schema[field], jsonType(v))
+		}
+		return nil
+	})
+	if err != nil && err != errSampled {
+		return nil, err
+	}
+
+	return schema, nil
+}
+
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case json.Number, float64:
+		return "number"
+	case bool:
+		return "bool"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	}
+	return "null"
+}
+
+func mergeType(have, seen string) string {
+	switch {
+	case have == "" || have == "null":
+		return seen
+	case seen == "null" || seen == have:
+		return have
+	}
+	return "mixed"
+}
+
+// FieldProfile sums up the values a top-level field takes across the
+// records ProfileFields sampled.
+type FieldProfile struct {
+	// Present counts the records holding the field, Nulls those of them
+	// where it is null.
+	Present int
+	Nulls   int
+
+	// Type is the field's type as InferSchema reports it.
+	Type string
+
+	// Min and Max are the smallest and largest numbers the field held, or
+	// nil if it never held one.
+	Min, Max *float64
+}
+
+// ProfileFields reads up to sampleSize of the collection's records, or all
+// of them if sampleSize isn't positive, and profiles every top-level field
+// seen in them.
+func (d *Driver) ProfileFields(collection string, sampleSize int) (map[string]FieldProfile, error) {
+	if _, ok := d.codec.(JSONCodec); !ok {
+		return nil, fmt.Errorf("unable to profile fields - records stored with %T can't be inspected as JSON", d.codec)
+	}
+
+	profiles := make(map[string]FieldProfile)
+	seen := 0
+	err := d.eachRecord(collection, func(resource string, b []byte) error {
+		if sampleSize > 0 && seen == sampleSize {
+			return errSampled
+		}
+		seen++
+
+		for field, v := range d.indexDoc(collection, b) {
+			p := profiles[field]
+			p.Present++
+			p.Type = mergeType(p.Type, jsonType(v))
+
+			switch v := v.(type) {
+			case nil:
+				p.Nulls++
+			case json.Number:
+				if f, err := v.Float64(); err == nil {
+					if p.Min == nil || f < *p.Min {
+						p.Min = &f
+					}
+					if p.Max == nil || f > *p.Max {
+						p.Max = &f
+					}
+				}
+			}
+
+			profiles[field] = p
+		}
+		return nil
+	})
+	if err != nil && err != errSampled {
+		return nil, err
+	}
+
+	return profiles, nil
+}
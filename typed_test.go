@@ -0,0 +1,359 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeCorruptUsers stores two valid users and one record that isn't JSON.
+func writeCorruptUsers(t *testing.T, db *Driver) {
+	t.Helper()
+
+	for _, name := range []string{"Eren", "Mikasa"} {
+		if err := db.Write("users", name, User{Name: name}); err != nil {
+			t.Fatalf("Write %s: %v", name, err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(db.Dir(), "users", "Broken.json"), []byte("{not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOnDecodeErrorFail(t *testing.T) {
+	db := newTestDriver(t, nil)
+	writeCorruptUsers(t, db)
+
+	if _, err := ReadAllTyped[User](db, "users"); err == nil {
+		t.Error("ReadAllTyped succeeded despite a corrupt record")
+	}
+}
+
+func TestOnDecodeErrorSkip(t *testing.T) {
+	db := newTestDriver(t, &Options{OnDecodeError: SkipOnDecodeError})
+	writeCorruptUsers(t, db)
+
+	users, err := ReadAllTyped[User](db, "users")
+	if err != nil {
+		t.Fatalf("ReadAllTyped: %v", err)
+	}
+	if len(users) != 2 || users[0].Name != "Eren" || users[1].Name != "Mikasa" {
+		t.Errorf("ReadAllTyped = %+v, want Eren and Mikasa", users)
+	}
+}
+
+func TestOnDecodeErrorReplacement(t *testing.T) {
+	var seen []string
+	db := newTestDriver(t, &Options{
+		OnDecodeError: func(collection, resource string, data []byte, err error) (interface{}, error) {
+			seen = append(seen, resource)
+			return &User{Name: "placeholder"}, nil
+		},
+	})
+	writeCorruptUsers(t, db)
+
+	users, err := Find(db, "users", func(u User) bool { return true })
+	if err != nil {
+		t.Fatalf("Find: %v", err)
+	}
+	if len(users) != 3 || users[0].Name != "placeholder" {
+		t.Errorf("Find = %+v, want the corrupt record replaced", users)
+	}
+	if len(seen) != 1 || seen[0] != "Broken" {
+		t.Errorf("handler called for %v, want [Broken]", seen)
+	}
+}
+
+func TestOnDecodeErrorAbortsForEach(t *testing.T) {
+	stop := errors.New("stop")
+	db := newTestDriver(t, &Options{
+		OnDecodeError: func(collection, resource string, data []byte, err error) (interface{}, error) {
+			return nil, stop
+		},
+	})
+	writeCorruptUsers(t, db)
+
+	var visited []string
+	err := ForEach(db, "users", func(resource string, u User) error {
+		visited = append(visited, resource)
+		return nil
+	})
+	if !errors.Is(err, stop) {
+		t.Errorf("ForEach error = %v, want the handler's error", err)
+	}
+	if len(visited) != 0 {
+		t.Errorf("ForEach visited %v before the corrupt record, want nothing", visited)
+	}
+}
+
+func TestCountWhere(t *testing.T) {
+	db := newTestDriver(t, nil)
+	writeEmployees(t, db)
+
+	n, err := CountWhere(db, "users", func(u User) bool {
+		age, err := u.Age.Int64()
+		return err == nil && age >= 30
+	})
+	if err != nil {
+		t.Fatalf("CountWhere: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("CountWhere(Age >= 30) = %d, want 2", n)
+	}
+}
+
+func TestCardinalityOf(t *testing.T) {
+	db := newTestDriver(t, nil)
+	writeEmployees(t, db)
+
+	n, err := CardinalityOf(db, "users", func(u User) string { return u.Company })
+	if err != nil {
+		t.Fatalf("CardinalityOf: %v", err)
+	}
+	if n != 6 {
+		t.Errorf("distinct companies = %d, want 6", n)
+	}
+
+	n, err = CardinalityOf(db, "users", func(u User) string { return u.Address.Country })
+	if err != nil {
+		t.Fatalf("CardinalityOf: %v", err)
+	}
+	if n != 5 {
+		t.Errorf("distinct countries = %d, want 5", n)
+	}
+}
+
+type circle struct {
+	Type   string `json:"_type"`
+	Radius float64
+}
+
+type square struct {
+	Type string `json:"_type"`
+	Side float64
+}
+
+type settings struct {
+	Name  string
+	Theme string
+}
+
+func TestRegisterDefaults(t *testing.T) {
+	db := newTestDriver(t, nil)
+	RegisterDefaults(db, func() settings { return settings{Theme: "dark"} })
+
+	// Eren's record predates the Theme field.
+	if err := db.Write("settings", "Eren", map[string]string{"Name": "Eren"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := db.Write("settings", "Mikasa", settings{Name: "Mikasa", Theme: "light"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	s, err := ReadTyped[settings](db, "settings", "Eren")
+	if err != nil {
+		t.Fatalf("ReadTyped: %v", err)
+	}
+	if want := (settings{Name: "Eren", Theme: "dark"}); s != want {
+		t.Errorf("ReadTyped = %+v, want %+v", s, want)
+	}
+
+	all, err := ReadAllTyped[settings](db, "settings")
+	if err != nil {
+		t.Fatalf("ReadAllTyped: %v", err)
+	}
+	want := []settings{{Name: "Eren", Theme: "dark"}, {Name: "Mikasa", Theme: "light"}}
+	if !reflect.DeepEqual(all, want) {
+		t.Errorf("ReadAllTyped = %+v, want %+v", all, want)
+	}
+
+	if err := db.Write("users", "Eren", map[string]string{"Name": "Eren"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if u, err := ReadTyped[User](db, "users", "Eren"); err != nil || u.Company != "" {
+		t.Errorf("ReadTyped[User] = %+v, %v, want no defaults for an unregistered type", u, err)
+	}
+}
+
+func TestReadAllPolymorphic(t *testing.T) {
+	db := newTestDriver(t, &Options{OnDecodeError: SkipOnDecodeError})
+	db.RegisterType("shapes", "circle", circle{})
+	db.RegisterType("shapes", "square", &square{})
+
+	for resource, v := range map[string]interface{}{
+		"a": circle{Type: "circle", Radius: 2},
+		"b": square{Type: "square", Side: 3},
+		"c": map[string]string{"_type": "triangle"},
+	} {
+		if err := db.Write("shapes", resource, v); err != nil {
+			t.Fatalf("Write %s: %v", resource, err)
+		}
+	}
+
+	records, err := db.ReadAllPolymorphic("shapes")
+	if err != nil {
+		t.Fatalf("ReadAllPolymorphic: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("ReadAllPolymorphic = %#v, want the circle and the square", records)
+	}
+	if c, ok := records[0].(circle); !ok || c.Radius != 2 {
+		t.Errorf("records[0] = %#v, want circle{Radius: 2}", records[0])
+	}
+	if s, ok := records[1].(*square); !ok || s.Side != 3 {
+		t.Errorf("records[1] = %#v, want &square{Side: 3}", records[1])
+	}
+}
+
+func TestReadAllPolymorphicUnknownTypeFails(t *testing.T) {
+	db := newTestDriver(t, nil)
+	if err := db.Write("shapes", "c", map[string]string{"_type": "triangle"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if _, err := db.ReadAllPolymorphic("shapes"); err == nil {
+		t.Error("ReadAllPolymorphic accepted an unregistered type")
+	}
+}
+
+func TestInferSchema(t *testing.T) {
+	db := newTestDriver(t, nil)
+	writeEmployees(t, db)
+
+	schema, err := db.InferSchema("users", 0)
+	if err != nil {
+		t.Fatalf("InferSchema: %v", err)
+	}
+	want := map[string]string{
+		"Name":    "string",
+		"Age":     "number",
+		"Contact": "string",
+		"Company": "string",
+		"Address": "object",
+	}
+	if !reflect.DeepEqual(schema, want) {
+		t.Errorf("InferSchema = %v, want %v", schema, want)
+	}
+
+	for resource, v := range map[string]interface{}{
+		"a": map[string]interface{}{"tags": nil, "id": 1},
+		"b": map[string]interface{}{"tags": []string{"x"}, "id": "two"},
+	} {
+		if err := db.Write("mixed", resource, v); err != nil {
+			t.Fatalf("Write %s: %v", resource, err)
+		}
+	}
+	schema, err = db.InferSchema("mixed", 10)
+	if err != nil {
+		t.Fatalf("InferSchema: %v", err)
+	}
+	if want := map[string]string{"tags": "array", "id": "mixed"}; !reflect.DeepEqual(schema, want) {
+		t.Errorf("InferSchema(mixed) = %v, want %v", schema, want)
+	}
+
+	schema, err = db.InferSchema("mixed", 1)
+	if err != nil {
+		t.Fatalf("InferSchema: %v", err)
+	}
+	if want := map[string]string{"tags": "null", "id": "number"}; !reflect.DeepEqual(schema, want) {
+		t.Errorf("InferSchema sampling one record = %v, want %v", schema, want)
+	}
+}
+
+func TestStream(t *testing.T) {
+	db := newTestDriver(t, nil)
+	writeEmployees(t, db)
+
+	reads := &countingStorage{}
+	db.storage = reads
+
+	it, err := Stream(db, "users", func(u User) bool { return u.Address.Country == "india" })
+	if err != nil {
+		t.Fatalf("Stream: %v", err)
+	}
+	if reads.reads != 0 {
+		t.Errorf("Stream read %d records before Next", reads.reads)
+	}
+
+	if !it.Next() {
+		t.Fatalf("Next = false, %v", it.Err())
+	}
+	// Records come in name order: Eren, Erwin, ...
+	if it.Resource() != "Erwin" || it.Value().Name != "Erwin" || reads.reads != 2 {
+		t.Errorf("first match %s %+v after %d reads, want Erwin after 2", it.Resource(), it.Value(), reads.reads)
+	}
+
+	var names []string
+	names = append(names, it.Value().Name)
+	for it.Next() {
+		names = append(names, it.Value().Name)
+	}
+	if it.Err() != nil {
+		t.Fatalf("Err: %v", it.Err())
+	}
+	if want := []string{"Erwin", "Mikasa"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("streamed %v, want %v", names, want)
+	}
+}
+
+func TestReadAllChan(t *testing.T) {
+	db := newTestDriver(t, nil)
+	writeEmployees(t, db)
+
+	records, errs := ReadAllChan[User](db, "users")
+	n := 0
+	for u := range records {
+		if u.Name == "" {
+			t.Errorf("received an empty record")
+		}
+		n++
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("ReadAllChan: %v", err)
+	}
+	if n != 6 {
+		t.Errorf("received %d records, want 6", n)
+	}
+
+	writeCorruptUsers(t, db)
+	records, errs = ReadAllChan[User](db, "users")
+	for range records {
+	}
+	if err := <-errs; err == nil {
+		t.Error("ReadAllChan reported no error for a corrupt record")
+	}
+
+	records, errs = ReadAllChan[User](db, "missing")
+	for range records {
+	}
+	if err := <-errs; err == nil {
+		t.Error("ReadAllChan of a missing collection reported no error")
+	}
+}
+
+func TestProfileFields(t *testing.T) {
+	db := newTestDriver(t, nil)
+	writeEmployees(t, db)
+	if err := db.Write("users", "Levi", map[string]interface{}{"Name": "Levi", "Age": nil}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	profiles, err := db.ProfileFields("users", 0)
+	if err != nil {
+		t.Fatalf("ProfileFields: %v", err)
+	}
+
+	age := profiles["Age"]
+	if age.Present != 7 || age.Nulls != 1 || age.Type != "number" {
+		t.Errorf("Age profile = %+v, want 7 present, 1 null, number", age)
+	}
+	if age.Min == nil || age.Max == nil || *age.Min != 23 || *age.Max != 34 {
+		t.Errorf("Age range = %v..%v, want 23..34", age.Min, age.Max)
+	}
+
+	if company := profiles["Company"]; company.Present != 6 || company.Min != nil {
+		t.Errorf("Company profile = %+v, want 6 present and no range", company)
+	}
+}
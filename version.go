@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// versionsFile holds, in the database directory, every collection's
+// version counter. It lives outside the collection directories so a
+// collection's version survives the collection being deleted.
+const versionsFile = "_versions.json"
+
+// versionBlock is how many versions of a collection are reserved in
+// versionsFile at a time. Versions are counted in memory and the file is
+// only rewritten once a collection's reservation runs out, so most changes
+// don't write it at all.
+const versionBlock = 1024
+
+// CollectionVersion returns a number that goes up every time a record of
+// the collection is written or deleted, or the collection is deleted,
+// replaced or rotated through this Driver, and stays the same otherwise.
+// It is 0 for a collection that has never changed. Versions are saved in
+// blocks, so once the database is reopened they carry on from at or past
+// where they were, and a version is never handed out twice.
+func (d *Driver) CollectionVersion(collection string) (uint64, error) {
+	if collection == "" {
+		return 0, fmt.Errorf("missing collection - no place to read a version")
+	}
+
+	d.versionMutex.Lock()
+	defer d.versionMutex.Unlock()
+
+	if err := d.loadVersions(); err != nil {
+		return 0, err
+	}
+
+	return d.versions[collection], nil
+}
+
+// bumpVersion increments the collection's version, reserving another block
+// in versionsFile when it passes the reserved one. It is called after
+// every change, with the collection's mutex held. The change has already
+// happened by then, so failing to save only logs a warning and saving is
+// tried again on the next change.
+func (d *Driver) bumpVersion(collection string) {
+	d.versionMutex.Lock()
+	defer d.versionMutex.Unlock()
+
+	if err := d.loadVersions(); err != nil {
+		d.log.Warn("Changed collection %s but could not read its version: %s", collection, err)
+		return
+	}
+	d.versions[collection]++
+	if d.versions[collection] <= d.reservedVersions[collection] {
+		return
+	}
+
+	reserved := make(map[string]uint64, len(d.reservedVersions)+1)
+	for c, v := range d.reservedVersions {
+		reserved[c] = v
+	}
+	reserved[collection] = d.versions[collection] + versionBlock - 1
+
+	b, err := marshal(reserved)
+	if err == nil {
+		err = d.writeFile(filepath.Join(d.Dir(), versionsFile), b)
+	}
+	if err != nil {
+		d.log.Warn("Changed collection %s but could not save its version: %s", collection, err)
+		return
+	}
+
+	d.reservedVersions = reserved
+}
+
+// loadVersions reads versionsFile the first time versions are needed,
+// starting each collection at the end of its reserved block. The caller
+// must hold versionMutex.
+func (d *Driver) loadVersions() error {
+	if d.versions != nil {
+		return nil
+	}
+
+	reserved := make(map[string]uint64)
+	b, err := ioutil.ReadFile(filepath.Join(d.Dir(), versionsFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &reserved); err != nil {
+			return fmt.Errorf("unable to read %s: %w", versionsFile, err)
+		}
+	}
+
+	versions := make(map[string]uint64, len(reserved))
+	for collection, v := range reserved {
+		versions[collection] = v
+	}
+
+	d.versions, d.reservedVersions = versions, reserved
+	return nil
+}
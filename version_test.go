@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCollectionVersion(t *testing.T) {
+	db := newTestDriver(t, nil)
+
+	version := func(want uint64) {
+		t.Helper()
+		if v, err := db.CollectionVersion("users"); err != nil || v != want {
+			t.Errorf("CollectionVersion = %d, %v, want %d", v, err, want)
+		}
+	}
+
+	version(0)
+	if err := db.Write("users", "Eren", User{Name: "Eren"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	version(1)
+
+	var u User
+	if err := db.Read("users", "Eren", &u); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if _, err := db.ReadAll("users"); err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	version(1)
+
+	if err := db.Write("orders", "1", []int{1}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	version(1)
+
+	if err := db.Delete("users", "Eren"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	version(2)
+
+	// Deleting the whole collection must not reset its version.
+	if err := db.Delete("users", ""); err != nil {
+		t.Fatalf("Delete collection: %v", err)
+	}
+	reopened, err := New(db.Dir(), nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	reopenedVersion, err := reopened.CollectionVersion("users")
+	if err != nil || reopenedVersion < 3 {
+		t.Errorf("CollectionVersion after reopening = %d, %v, want at least 3", reopenedVersion, err)
+	}
+	if err := reopened.Write("users", "Eren", User{Name: "Eren"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if v, err := reopened.CollectionVersion("users"); err != nil || v != reopenedVersion+1 {
+		t.Errorf("CollectionVersion after writing = %d, %v, want %d", v, err, reopenedVersion+1)
+	}
+}
+
+func TestCollectionVersionSaveFailureKeepsWrite(t *testing.T) {
+	db := newTestDriver(t, nil)
+	if _, err := db.CollectionVersion("users"); err != nil {
+		t.Fatalf("CollectionVersion: %v", err)
+	}
+
+	// A directory in its place makes saving the versions fail.
+	if err := os.Mkdir(filepath.Join(db.Dir(), versionsFile), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Write("users", "Eren", User{Name: "Eren"}); err != nil {
+		t.Fatalf("Write with the versions unsaved: %v", err)
+	}
+	if v, err := db.CollectionVersion("users"); err != nil || v != 1 {
+		t.Errorf("CollectionVersion = %d, %v, want 1", v, err)
+	}
+}